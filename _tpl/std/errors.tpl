@@ -0,0 +1,9 @@
+{{define "Main"}}
+		<p>These are the names currently cached by this server whose values had errors or warnings. Names with errors are served according to the parse error policy, which is <strong>{{if .Policy}}{{.Policy}}{{else}}partial{{end}}</strong>; warnings do not affect how names are served.</p>
+		<pre>
+{{range .Names}}<a href="/lookup?q={{.Name}}">{{.Name}}</a>{{range .Errors}}
+  {{if .IsWarning}}Warning{{else}}Error  {{end}}  {{.Message}}{{end}}
+
+{{else}}No cached names have errors.
+{{end}}</pre>
+{{end}}
@@ -96,6 +96,7 @@
       <ul>
         <li><a href="/">{{.CanonicalSuffix}}</a></li>
         <li><a href="/lookup">Lookup Domain or Validate JSON</a></li>
+        <li><a href="/errors">Value Errors</a></li>
       </ul>
     </div>
     <div id="main">
@@ -104,6 +105,7 @@
       </div>
       <div id="statusline">
         Served by {{.SelfName}} at {{.Time}}
+        {{if .Chain.Checked}}&mdash; Namecoin block {{.Chain.Height}}{{if .Chain.Synced}} (synced){{else}} of {{.Chain.Headers}} (<strong>not synced</strong>; chain tip from {{.Chain.TipTime.UTC.Format "2006-01-02 15:04:05"}} UTC{{if .Chain.InitialBlockDownload}}, in initial block download{{end}}){{end}}{{end}}
       </div>
     </div>
   </body>
@@ -19,7 +19,8 @@ Domain Name:    <span class="rv">{{.DomainName}}</span>
 Bare Name:      <span class="rv">{{.BareName}}</span>
 
 Exists:         {{if .ExistenceError}}{{.ExistenceError}}{{else}}Yes{{end}}
-{{if not .ExistenceError}}Expired:        {{.Expired}}{{end}}
+{{if not .ExistenceError}}{{if not .JSONMode}}Expired:        {{if .Expired}}Yes{{else}}No ({{.ExpiresIn}} blocks remaining){{end}}
+Last Updated:   Block {{.Height}}{{end}}{{end}}
 {{if not .ExistenceError}}
 Valid:          {{.Valid}}
 
@@ -2,6 +2,7 @@ package backend
 
 import "github.com/miekg/dns"
 import "github.com/golang/groupcache/lru"
+import "github.com/golang/groupcache/singleflight"
 import "gopkg.in/hlandau/madns.v1/merr"
 import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/util"
@@ -9,6 +10,8 @@ import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/namecoin/ncdns/tlshook"
 import "github.com/hlandau/xlog"
 import "sync"
+import "sync/atomic"
+import "context"
 import "fmt"
 import "net"
 import "net/mail"
@@ -19,12 +22,146 @@ import "time"
 type Backend struct {
 	//s *Server
 	nc         namecoin.Conn
-	cache      lru.Cache // items are of type *Domain
+	cache      lru.Cache // items are of type *domain
+	negCache   lru.Cache // items are of type time.Time (expiry time)
 	cacheMutex sync.Mutex
 	cfg        Config
+
+	// Maps names (like "d/example") to the set of cached names whose values
+	// were constructed using them via "import" or "delegate". Protected by
+	// cacheMutex.
+	dependents map[string]map[string]struct{}
+
+	// Incremented whenever cached names are invalidated, so that values
+	// retrieved before an invalidation are not added to the cache after it.
+	// Protected by cacheMutex.
+	generation uint64
+
+	// The errors and warnings produced when parsing the values of cached
+	// names, for names which had any. Protected by cacheMutex.
+	parseErrors map[string][]ParseError
+
+	// Used to ensure that concurrent cache misses for the same name result in
+	// only one lookup. entryGroup covers retrieving and parsing a name,
+	// queryGroup covers the Namecoin RPC call only (and so is also used for
+	// names referenced by "import").
+	entryGroup singleflight.Group
+	queryGroup singleflight.Group
+
+	// The current block height or the error encountered retrieving it,
+	// cached until heightExpire, and the SOA serial. Protected by
+	// heightMutex.
+	heightMutex  sync.Mutex
+	height       int
+	heightErr    error
+	heightExpire time.Time
+	serial       uint32
+
+	// Set by SetSynced.
+	unsynced int32
+
+	// Networks whose addresses are removed from values.
+	deniedNetworks []*net.IPNet
 }
 
 const defaultMaxEntries = 100
+const defaultCacheMaxAge = 10 * time.Minute
+const defaultNegativeMaxEntries = 1000
+const defaultNegativeCacheMaxAge = 1 * time.Minute
+
+// Be generous with the default timeout as responses from the Namecoin
+// JSON-RPC seem sluggish sometimes.
+const defaultNamecoinTimeout = 1500 * time.Millisecond
+
+const defaultApexTTL = 24 * time.Hour
+const defaultSOARefresh = 10 * time.Minute
+const defaultSOARetry = 10 * time.Minute
+const defaultSOAExpire = 2 * time.Hour
+const defaultSOAMinimum = 10 * time.Minute
+
+// Maximum depth of "import" references to retrieve in advance when parsing a
+// value.
+const prefetchDepth = 4
+
+// TTL of records served from an expired cache entry, and the interval between
+// attempts to refresh such entries, as recommended by RFC 8767.
+const staleTTL = 30
+const staleRetryInterval = 30 * time.Second
+
+// Maximum time for which the current block height, or a failure to retrieve
+// it, is cached.
+const heightCacheMaxAge = 10 * time.Second
+
+// TTL of records served while the Namecoin daemon is not synced, if
+// UnsyncedShortTTL is used.
+const unsyncedTTL = 60
+
+// Determines how names are served while the Namecoin daemon is not synced
+// with the network.
+type UnsyncedPolicy int
+
+const (
+	// Serve names as usual.
+	UnsyncedWarn UnsyncedPolicy = iota
+
+	// Serve names with a short TTL.
+	UnsyncedShortTTL
+
+	// Fail lookups of names with ErrUnsynced.
+	UnsyncedServfail
+)
+
+// Determines how names whose values have errors are served.
+type ParseErrorPolicy int
+
+const (
+	// Serve whatever could be parsed from the value.
+	ParseErrorServePartial ParseErrorPolicy = iota
+
+	// Fail lookups of the name.
+	ParseErrorServfail
+
+	// Treat the name as nonexistent.
+	ParseErrorNXDomain
+)
+
+// An error or warning produced while parsing the value of a name.
+type ParseError struct {
+	Message   string
+	IsWarning bool
+}
+
+// Returned by lookups of names while the Namecoin daemon is not synced, if
+// UnsyncedServfail is used.
+var ErrUnsynced = fmt.Errorf("namecoin daemon is not synced")
+
+// Extended DNS Error info codes (RFC 8914) used to explain lookup failures.
+const (
+	EDEOther                = 0
+	EDEStaleAnswer          = 3
+	EDENotReady             = 14
+	EDENoReachableAuthority = 22
+	EDENetworkError         = 23
+	EDEInvalidData          = 24
+)
+
+// An Extended DNS Error (RFC 8914) explaining why a lookup failed, or why
+// its answer is stale.
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string
+}
+
+// An error in the value of a Namecoin name, as opposed to a failure to
+// retrieve it.
+type valueError struct {
+	name string
+	msg  string
+}
+
+func (e *valueError) Error() string {
+	return e.name + ": " + e.msg
+}
 
 var log, Log = xlog.New("ncdns.backend")
 
@@ -32,9 +169,51 @@ var log, Log = xlog.New("ncdns.backend")
 type Config struct {
 	NamecoinConn namecoin.Conn
 
+	// Maximum time to wait for a response from the Namecoin daemon. If zero,
+	// a default value is used.
+	NamecoinTimeout time.Duration
+
 	// Maximum entries to permit in name cache. If zero, a default value is used.
 	CacheMaxEntries int
 
+	// Maximum time for which a name may be kept in the name cache. An entry
+	// also expires no later than the lowest TTL of the records generated from
+	// it. If zero, a default value is used.
+	CacheMaxAge time.Duration
+
+	// Maximum entries to permit in the cache of nonexistent names. If zero, a
+	// default value is used.
+	NegativeCacheMaxEntries int
+
+	// Time for which a name found not to exist is remembered as nonexistent.
+	// If zero, a default value is used.
+	NegativeCacheMaxAge time.Duration
+
+	// Time for which a cached name may be served after it has expired, if it
+	// cannot be refreshed because the Namecoin daemon is unreachable or not
+	// responding (RFC 8767). Records served stale have a reduced TTL. If zero,
+	// expired names are never served.
+	StaleMaxAge time.Duration
+
+	// If true, names which have expired are served as though they had not.
+	// By default, expired names do not exist.
+	ServeExpired bool
+
+	// Minimum number of confirmations which the current value of a name must
+	// have before it is served. If the most recent update to a name is more
+	// recent than this, the previous value is served instead, which requires
+	// namecoind to be run with -namehistory. A name's value is considered
+	// confirmed once the block containing it has been mined; if this is zero
+	// or one, values are served as soon as they are confirmed.
+	MinConfirmations int
+
+	// Determines how names are served after SetSynced(false) is called.
+	UnsyncedPolicy UnsyncedPolicy
+
+	// Determines how names whose values have errors are served. Warnings do
+	// not affect how names are served.
+	ParseErrorPolicy ParseErrorPolicy
+
 	// Nameservers to advertise at zone apex. The first is considered the primary.
 	// If empty, a psuedo-hostname resolvable to SelfIP is used.
 	CanonicalNameservers []string
@@ -42,6 +221,18 @@ type Config struct {
 	// Vanity IPs to place at the zone apex.
 	VanityIPs []net.IP
 
+	// If true, private, loopback, link-local and other reserved addresses are
+	// removed from values, so that names can't be used for DNS rebinding
+	// attacks against hosts on the local network.
+	DenyReservedAddresses bool
+
+	// Further networks whose addresses are removed from values.
+	DeniedNetworks []*net.IPNet
+
+	// Networks whose addresses are never removed from values, even if they
+	// are denied by the above.
+	AllowedNetworks []*net.IPNet
+
 	// Used only if CanonicalNameservers is left blank. An IP which the internal
 	// psuedo-hostname should resolve to. This should be the public IP of the
 	// nameserver serving the zone expressed by this backend.
@@ -50,6 +241,28 @@ type Config struct {
 	// Hostmaster in e. mail form (e.g. "hostmaster@example.com").
 	Hostmaster string
 
+	// TTL of the SOA, NS and vanity IP records at the zone apex. If zero, a
+	// default value is used.
+	ApexTTL time.Duration
+
+	// Timers to place in the SOA record at the zone apex. If zero, default
+	// values are used. The SOA serial is described under ExternalSerial.
+	SOARefresh time.Duration
+	SOARetry   time.Duration
+	SOAExpire  time.Duration
+	SOAMinimum time.Duration
+
+	// If set, the SOA serial changes only when AdvanceSerial is called, as
+	// when it is taken from a copy of the zone maintained for zone transfers.
+	// Otherwise it follows the block height.
+	ExternalSerial bool
+
+	// Serve an SOA record at the apex of each Namecoin domain which isn't
+	// delegated elsewhere. The domains remain part of the .bit zone, with no
+	// NS records or keys of their own, so this is not a true zone cut and
+	// validating resolvers may reject the resulting answers.
+	DomainSOA bool
+
 	// Map names (like "d/example") to strings containing JSON values. Used to provide
 	// fake names for testing purposes. You don't need to use this.
 	FakeNames map[string]string
@@ -69,6 +282,51 @@ func New(cfg *Config) (backend *Backend, err error) {
 	if b.cache.MaxEntries == 0 {
 		b.cache.MaxEntries = defaultMaxEntries
 	}
+	b.cache.OnEvicted = b.onEvicted
+	b.dependents = map[string]map[string]struct{}{}
+	b.parseErrors = map[string][]ParseError{}
+
+	if b.cfg.NamecoinTimeout == 0 {
+		b.cfg.NamecoinTimeout = defaultNamecoinTimeout
+	}
+
+	if b.cfg.CacheMaxAge == 0 {
+		b.cfg.CacheMaxAge = defaultCacheMaxAge
+	}
+
+	b.negCache.MaxEntries = cfg.NegativeCacheMaxEntries
+	if b.negCache.MaxEntries == 0 {
+		b.negCache.MaxEntries = defaultNegativeMaxEntries
+	}
+
+	if b.cfg.NegativeCacheMaxAge == 0 {
+		b.cfg.NegativeCacheMaxAge = defaultNegativeCacheMaxAge
+	}
+
+	if b.cfg.ApexTTL == 0 {
+		b.cfg.ApexTTL = defaultApexTTL
+	}
+
+	if b.cfg.SOARefresh == 0 {
+		b.cfg.SOARefresh = defaultSOARefresh
+	}
+
+	if b.cfg.SOARetry == 0 {
+		b.cfg.SOARetry = defaultSOARetry
+	}
+
+	if b.cfg.SOAExpire == 0 {
+		b.cfg.SOAExpire = defaultSOAExpire
+	}
+
+	if b.cfg.SOAMinimum == 0 {
+		b.cfg.SOAMinimum = defaultSOAMinimum
+	}
+
+	if b.cfg.DenyReservedAddresses {
+		b.deniedNetworks = append(b.deniedNetworks, reservedNetworks...)
+	}
+	b.deniedNetworks = append(b.deniedNetworks, b.cfg.DeniedNetworks...)
 
 	hostmaster, err := convertEmail(b.cfg.Hostmaster)
 	if err != nil {
@@ -110,7 +368,62 @@ func (b *Backend) Lookup(qname string) (rrs []dns.RR, err error) {
 	btx := &btx{}
 	btx.b = b
 	btx.qname = qname
-	return btx.Do()
+	rrs, err = btx.Do()
+	return
+}
+
+// Like Lookup, but also returns the reason why the lookup of the Namecoin
+// domain containing qname failed or was answered with stale data, if it was,
+// for reporting to clients. ee is nil otherwise.
+func (b *Backend) LookupExtended(qname string) (rrs []dns.RR, ee *ExtendedError, err error) {
+	btx := &btx{}
+	btx.b = b
+	btx.qname = qname
+	rrs, err = btx.Do()
+	return rrs, btx.ee, err
+}
+
+// Returns an Extended DNS Error if the Namecoin domain containing qname is
+// cached but has expired, and so would be answered with stale data. Unlike
+// LookupExtended, this never queries namecoind. Returns nil otherwise.
+func (b *Backend) StaleError(qname string) *ExtendedError {
+	_, basename, rootname, err := util.SplitDomainByFloatingAnchor(qname, "bit")
+	if err != nil || rootname == "" || basename == "" {
+		return nil
+	}
+
+	ncname, err := util.BasenameToNamecoinKey(basename)
+	if err != nil {
+		return nil
+	}
+
+	d, err := b.getNamecoinEntryCache(ncname)
+	if err != nil || d == nil || time.Now().Before(d.expire) {
+		return nil
+	}
+
+	return &ExtendedError{EDEStaleAnswer, "namecoind could not be queried for " + ncname}
+}
+
+// Returns the Extended DNS Error describing an error encountered while
+// retrieving the given Namecoin name.
+func extendedErrorFor(ncname string, err error) *ExtendedError {
+	if err == merr.ErrNoSuchDomain {
+		return &ExtendedError{EDEOther, ncname + " does not exist or has expired"}
+	}
+
+	if verr, ok := err.(*valueError); ok {
+		return &ExtendedError{EDEInvalidData, verr.Error()}
+	}
+
+	if err == context.DeadlineExceeded {
+		return &ExtendedError{EDENoReachableAuthority, "timed out querying namecoind for " + ncname}
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return &ExtendedError{EDENoReachableAuthority, "timed out querying namecoind for " + ncname}
+	}
+
+	return &ExtendedError{EDENetworkError, "couldn't query namecoind for " + ncname}
 }
 
 // Things to keep track of while processing a query.
@@ -119,6 +432,10 @@ type btx struct {
 	qname string
 
 	subname, basename, rootname string
+
+	// The reason why the lookup of the Namecoin name failed or was answered
+	// with stale data, if it was.
+	ee *ExtendedError
 }
 
 func (tx *btx) Do() (rrs []dns.RR, err error) {
@@ -162,26 +479,33 @@ func (tx *btx) determineDomain() (subname, basename, rootname string, err error)
 	return util.SplitDomainByFloatingAnchor(tx.qname, "bit")
 }
 
-func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
-	nss := tx.b.cfg.CanonicalNameservers
+// Returns the names of the nameservers for the zone.
+func (tx *btx) nameservers() []string {
 	if len(tx.b.cfg.CanonicalNameservers) == 0 {
-		nss = []string{dns.Fqdn("this.x--nmc." + tx.rootname)}
+		return []string{dns.Fqdn("this.x--nmc." + tx.rootname)}
 	}
 
+	return tx.b.cfg.CanonicalNameservers
+}
+
+func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
+	nss := tx.nameservers()
+	apexTTL := seconds(tx.b.cfg.ApexTTL)
+
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   dns.Fqdn(tx.rootname),
-			Ttl:    86400,
+			Ttl:    apexTTL,
 			Class:  dns.ClassINET,
 			Rrtype: dns.TypeSOA,
 		},
 		Ns:      nss[0],
 		Mbox:    tx.b.cfg.Hostmaster,
-		Serial:  1,
-		Refresh: 600,
-		Retry:   600,
-		Expire:  7200,
-		Minttl:  600,
+		Serial:  tx.b.soaSerial(),
+		Refresh: seconds(tx.b.cfg.SOARefresh),
+		Retry:   seconds(tx.b.cfg.SOARetry),
+		Expire:  seconds(tx.b.cfg.SOAExpire),
+		Minttl:  seconds(tx.b.cfg.SOAMinimum),
 	}
 
 	rrs = make([]dns.RR, 0, 1+len(nss)+len(tx.b.cfg.VanityIPs))
@@ -190,7 +514,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 		ns := &dns.NS{
 			Hdr: dns.RR_Header{
 				Name:   dns.Fqdn(tx.rootname),
-				Ttl:    86400,
+				Ttl:    apexTTL,
 				Class:  dns.ClassINET,
 				Rrtype: dns.TypeNS,
 			},
@@ -205,7 +529,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 			a := &dns.A{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
+					Ttl:    apexTTL,
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeA,
 				},
@@ -216,7 +540,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 			a := &dns.AAAA{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
+					Ttl:    apexTTL,
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeAAAA,
 				},
@@ -229,6 +553,117 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 	return
 }
 
+// Returns the SOA serial for the zone. Unless ExternalSerial is set, this is
+// the highest block height yet seen, as passed to SetBlockHeight or obtained
+// when checking the confirmations of names. The serial never decreases, even
+// if the block height does due to a chain reorganisation. Namecoin is not
+// queried, so that lookups of the zone apex don't wait for it.
+func (b *Backend) soaSerial() uint32 {
+	b.heightMutex.Lock()
+	defer b.heightMutex.Unlock()
+
+	if b.serial == 0 {
+		return 1
+	}
+
+	return b.serial
+}
+
+// Ensures that the SOA serial is at least the given value. This is used to
+// keep the serial consistent with that of a copy of the zone maintained
+// elsewhere, such as for zone transfers, in which case ExternalSerial should
+// be set.
+func (b *Backend) AdvanceSerial(serial uint32) {
+	b.heightMutex.Lock()
+	defer b.heightMutex.Unlock()
+
+	if serial > b.serial {
+		b.serial = serial
+	}
+}
+
+// Returns the records which the given Namecoin name (e.g. "d/example"),
+// having the given value, contributes to the zone "bit.", as they would
+// appear in a zone file. Names referenced via "import" or "delegate" are
+// resolved as for lookups, and are also returned. Returns
+// merr.ErrNoSuchDomain if the name does not contribute to the zone, such as
+// because it has expired.
+func (b *Backend) ZoneRRs(info *namecoin.NameInfo) (rrs []dns.RR, deps []string, err error) {
+	basename, err := util.NamecoinKeyToBasename(info.Name)
+	if err != nil {
+		return nil, nil, merr.ErrNoSuchDomain
+	}
+
+	err = b.checkExpired(info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d, err := b.jsonToDomain(info.Name, info.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = b.checkParseErrors(info.Name, d)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Per-domain SOAs are omitted, as the domains form part of the .bit zone
+	// here.
+	for dep := range d.deps {
+		deps = append(deps, dep)
+	}
+
+	rrs, err = d.ncv.RRsRecursive(nil, basename+".bit.", "bit.")
+	return rrs, deps, err
+}
+
+// Returns glue A and AAAA records for the given nameserver name, which must be
+// within a Namecoin domain delegated via an ns item. These are taken from the
+// ip and ip6 items of the value at that name, which would otherwise be hidden
+// by the delegation. Returns merr.ErrNoSuchDomain if there is no such value.
+func (b *Backend) Glue(name string) (rrs []dns.RR, err error) {
+	tx := &btx{b: b, qname: dns.Fqdn(name)}
+	tx.subname, tx.basename, tx.rootname, err = tx.determineDomain()
+	if err != nil || tx.rootname == "" || tx.basename == "" {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	ncname, err := util.BasenameToNamecoinKey(tx.basename)
+	if err != nil {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	d, _, err := b.getNamecoinEntry(ncname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wildcards are not used for glue.
+	ncv := d.ncv
+	for rest := tx.subname; rest != ""; {
+		var head string
+		head, rest = util.SplitDomainHead(rest)
+		ncv = ncv.Map[head]
+		if ncv == nil {
+			return nil, merr.ErrNoSuchDomain
+		}
+	}
+
+	addrs := &ncdomain.Value{
+		IP:  ncv.IP,
+		IP6: ncv.IP6,
+	}
+
+	return addrs.RRs(nil, tx.qname, dns.Fqdn(tx.basename+"."+tx.rootname))
+}
+
+// Converts a duration to a number of seconds for use in a DNS record.
+func seconds(d time.Duration) uint32 {
+	return uint32(d / time.Second)
+}
+
 func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
 	ip := net.ParseIP(tx.b.cfg.SelfIP)
 	if ip == nil || ip.To4() == nil {
@@ -261,8 +696,21 @@ func (tx *btx) doUserDomain() (rrs []dns.RR, err error) {
 		return
 	}
 
-	d, err := tx.b.getNamecoinEntry(ncname)
+	unsynced := tx.b.isUnsynced()
+	if unsynced && tx.b.cfg.UnsyncedPolicy == UnsyncedServfail {
+		tx.ee = &ExtendedError{EDENotReady, "namecoind is not synced"}
+		return nil, ErrUnsynced
+	}
+
+	d, stale, err := tx.b.getNamecoinEntry(ncname)
+	if err != nil {
+		tx.ee = extendedErrorFor(ncname, err)
+		return nil, err
+	}
+
+	err = tx.b.checkParseErrors(ncname, d)
 	if err != nil {
+		tx.ee = &ExtendedError{EDEInvalidData, ncname + ": " + d.firstError().Message}
 		return nil, err
 	}
 
@@ -271,104 +719,759 @@ func (tx *btx) doUserDomain() (rrs []dns.RR, err error) {
 		return nil, err
 	}
 
+	if stale {
+		tx.ee = &ExtendedError{EDEStaleAnswer, "namecoind could not be queried for " + ncname}
+		rrs = limitTTLs(rrs, staleTTL)
+	} else if unsynced && tx.b.cfg.UnsyncedPolicy == UnsyncedShortTTL {
+		rrs = limitTTLs(rrs, unsyncedTTL)
+	}
+
 	return rrs, nil
 }
 
+// Informs the backend whether the Namecoin daemon is synced with the network,
+// and so whether the names it returns are up to date. How names are served
+// while it is not is determined by the UnsyncedPolicy configuration option.
+// The daemon is assumed to be synced until this is called.
+func (b *Backend) SetSynced(synced bool) {
+	var v int32
+	if !synced {
+		v = 1
+	}
+
+	atomic.StoreInt32(&b.unsynced, v)
+}
+
+func (b *Backend) isUnsynced() bool {
+	return atomic.LoadInt32(&b.unsynced) != 0
+}
+
+// Returns copies of the given RRs with their TTLs reduced to at most ttl. The
+// RRs are copied as some of them may be shared with a cached value.
+func limitTTLs(rrs []dns.RR, ttl uint32) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i := range rrs {
+		out[i] = dns.Copy(rrs[i])
+		if h := out[i].Header(); h.Ttl > ttl {
+			h.Ttl = ttl
+		}
+	}
+	return out
+}
+
 // Keep domains in parsed format.
 type domain struct {
-	ncv *ncdomain.Value
+	ncv    *ncdomain.Value
+	expire time.Time
+
+	// Other names which were used in constructing this value.
+	deps map[string]struct{}
+
+	// The block height at which the name was last updated, or 0 if unknown.
+	height int
+
+	// The errors and warnings produced when parsing the value.
+	parseErrors []ParseError
+
+	// If the value has expired and an attempt to refresh it has failed, it is
+	// served stale and no further attempt is made to refresh it before this
+	// time. Protected by cacheMutex.
+	retryAfter time.Time
 }
 
-func (b *Backend) getNamecoinEntry(name string) (*domain, error) {
-	d := b.getNamecoinEntryCache(name)
+// Retrieves a domain, from the cache if possible. If stale is true, the
+// domain has expired and could not be refreshed, and is being served stale.
+func (b *Backend) getNamecoinEntry(name string) (d *domain, stale bool, err error) {
+	d, err = b.getNamecoinEntryCache(name)
+	if err != nil {
+		return nil, false, err
+	}
+
 	if d != nil {
-		return d, nil
+		if time.Now().Before(d.expire) {
+			return d, false, nil
+		}
+
+		// The entry has expired but may still be served stale. If an attempt
+		// to refresh it has failed, don't make the client wait for another
+		// attempt; serve it stale and try to refresh it in the background,
+		// at most once per staleRetryInterval.
+		if serveStale, refresh := b.staleRefreshState(d); serveStale {
+			if refresh {
+				go b.refreshNamecoinEntry(name)
+			}
+			return d, true, nil
+		}
+	}
+
+	nd, err := b.refreshNamecoinEntry(name)
+	if err != nil && err != merr.ErrNoSuchDomain && d != nil {
+		log.Warne(err, "serving stale value for ", name)
+		return d, true, nil
 	}
 
-	d, err := b.getNamecoinEntryLL(name)
+	return nd, false, err
+}
+
+// Retrieves a domain from Namecoin and adds it to the cache.
+//
+// Concurrent calls share a single retrieval, unless the name has been
+// invalidated in the meantime.
+func (b *Backend) refreshNamecoinEntry(name string) (*domain, error) {
+	gen := b.cacheGeneration()
+	dd, err := b.entryGroup.Do(singleflightKey(name, gen), func() (interface{}, error) {
+		d, err := b.getNamecoinEntryLL(name)
+		if err == merr.ErrNoSuchDomain {
+			b.addNegativeEntryToCache(name, gen)
+			return nil, err
+		}
+		if err != nil {
+			b.deferStaleRetry(name)
+			return nil, err
+		}
+
+		b.addNamecoinEntryToCache(name, d, gen)
+		return d, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	b.addNamecoinEntryToCache(name, d)
-	return d, nil
+	return dd.(*domain), nil
 }
 
-func (b *Backend) getNamecoinEntryCache(name string) *domain {
+// Returns the cached domain for the given name, or merr.ErrNoSuchDomain if
+// the name is cached as nonexistent. Returns nil, nil on a cache miss.
+//
+// The domain returned may have expired if serving stale values is enabled.
+// Entries which have expired and are too old to be served stale are removed
+// and treated as misses.
+func (b *Backend) getNamecoinEntryCache(name string) (*domain, error) {
 	b.cacheMutex.Lock()
 	defer b.cacheMutex.Unlock()
 
+	now := time.Now()
+
 	if dd, ok := b.cache.Get(name); ok {
 		d := dd.(*domain)
-		return d
+		if now.Before(d.expire.Add(b.cfg.StaleMaxAge)) {
+			return d, nil
+		}
+
+		b.cache.Remove(name)
 	}
 
-	return nil
+	if ee, ok := b.negCache.Get(name); ok {
+		if now.Before(ee.(time.Time)) {
+			return nil, merr.ErrNoSuchDomain
+		}
+
+		b.negCache.Remove(name)
+	}
+
+	return nil, nil
+}
+
+// Determines whether an expired entry should be served stale without waiting
+// for an attempt to refresh it, which is the case once an attempt has failed.
+// If so, refresh is true if an attempt to refresh it in the background is due.
+// Such attempts are made at most once per staleRetryInterval, as with the
+// failure recheck timer of RFC 8767.
+func (b *Backend) staleRefreshState(d *domain) (serveStale, refresh bool) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if d.retryAfter.IsZero() {
+		return false, false
+	}
+
+	now := time.Now()
+	if now.Before(d.retryAfter) {
+		return true, false
+	}
+
+	d.retryAfter = now.Add(staleRetryInterval)
+	return true, true
+}
+
+// Called when refreshing a name fails. If a stale value is cached for the
+// name, it is served without waiting for a refresh for a while.
+func (b *Backend) deferStaleRetry(name string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if dd, ok := b.cache.Get(name); ok {
+		dd.(*domain).retryAfter = time.Now().Add(staleRetryInterval)
+	}
+}
+
+// Returns the current cache generation.
+func (b *Backend) cacheGeneration() uint64 {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	return b.generation
 }
 
-func (b *Backend) addNamecoinEntryToCache(name string, d *domain) {
+// Returns the key used to share retrievals of a name which began in the
+// given cache generation.
+func singleflightKey(name string, gen uint64) string {
+	return fmt.Sprintf("%s@%d", name, gen)
+}
+
+// Adds a domain to the cache, unless names have been invalidated since it
+// began to be retrieved in cache generation gen, in which case it may be out
+// of date.
+func (b *Backend) addNamecoinEntryToCache(name string, d *domain, gen uint64) {
 	b.cacheMutex.Lock()
 	defer b.cacheMutex.Unlock()
 
+	if gen != b.generation {
+		return
+	}
+
+	// Remove any existing entry first so that the names which depended on
+	// it are invalidated.
+	b.cache.Remove(name)
+	b.negCache.Remove(name)
 	b.cache.Add(name, d)
+
+	if len(d.parseErrors) > 0 {
+		b.parseErrors[name] = d.parseErrors
+	}
+
+	for dep := range d.deps {
+		m, ok := b.dependents[dep]
+		if !ok {
+			m = map[string]struct{}{}
+			b.dependents[dep] = m
+		}
+		m[name] = struct{}{}
+	}
+}
+
+func (b *Backend) addNegativeEntryToCache(name string, gen uint64) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	if gen != b.generation {
+		return
+	}
+
+	b.cache.Remove(name)
+	b.negCache.Add(name, time.Now().Add(b.cfg.NegativeCacheMaxAge))
+}
+
+// Removes any cached data for the given Namecoin name (e.g. "d/example"), so
+// that it is retrieved afresh the next time it is needed. Call this when a
+// name is known to have been updated. Any cached names which import or
+// delegate to the given name are also removed.
+func (b *Backend) InvalidateName(name string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.generation++
+	b.cache.Remove(name)
+	b.negCache.Remove(name)
+	b.invalidateDependents(name)
+}
+
+// Removes all cached data.
+func (b *Backend) InvalidateAll() {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.generation++
+	b.cache.Clear()
+	b.negCache.Clear()
+	b.dependents = map[string]map[string]struct{}{}
+	b.parseErrors = map[string][]ParseError{}
+}
+
+// Removes all cached names which depend on the given name. Must be called
+// with cacheMutex held.
+func (b *Backend) invalidateDependents(name string) {
+	deps := b.dependents[name]
+	delete(b.dependents, name)
+
+	for dep := range deps {
+		// This calls onEvicted, which recursively invalidates anything which
+		// depends on dep in turn.
+		b.cache.Remove(dep)
+	}
+}
+
+// Called by the LRU cache whenever an entry is removed, whether due to
+// eviction, expiry or invalidation. Always called with cacheMutex held.
+func (b *Backend) onEvicted(key lru.Key, value interface{}) {
+	name := key.(string)
+	d := value.(*domain)
+
+	delete(b.parseErrors, name)
+
+	for dep := range d.deps {
+		if m, ok := b.dependents[dep]; ok {
+			delete(m, name)
+			if len(m) == 0 {
+				delete(b.dependents, dep)
+			}
+		}
+	}
+
+	b.invalidateDependents(name)
 }
 
 func (b *Backend) getNamecoinEntryLL(name string) (*domain, error) {
-	v, err := b.resolveName(name)
+	info, err := b.resolveName(name)
 	if err != nil {
 		return nil, err
 	}
 
-	d, err := b.jsonToDomain(name, v)
+	d, err := b.jsonToDomain(name, info.Value)
 	if err != nil {
 		return nil, err
 	}
 
+	d.height = info.Height
 	return d, nil
 }
 
-func (b *Backend) resolveName(name string) (jsonValue string, err error) {
+func (b *Backend) resolveName(name string) (*namecoin.NameInfo, error) {
 	if fv, ok := b.cfg.FakeNames[name]; ok {
 		if fv == "NX" {
-			return "", merr.ErrNoSuchDomain
+			return nil, merr.ErrNoSuchDomain
 		}
-		return fv, nil
+		return &namecoin.NameInfo{Name: name, Value: fv}, nil
 	}
 
-	// The btcjson package has quite a long timeout, far in excess of standard
-	// DNS timeouts. We need to return an error response rapidly if we can't
-	// query the backend. Be generous with the timeout as responses from the
-	// Namecoin JSON-RPC seem sluggish sometimes.
-	result := make(chan struct{}, 1)
-	go func() {
-		jsonValue, err = b.nc.Query(name)
-		log.Errore(err, "failed to query namecoin")
-		result <- struct{}{}
-	}()
+	// Concurrent queries for the same name share a single RPC call, unless the
+	// name is invalidated in the meantime.
+	v, err := b.queryGroup.Do(singleflightKey(name, b.cacheGeneration()), func() (interface{}, error) {
+		return b.queryNamecoin(name)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	select {
-	case <-result:
-		return
-	case <-time.After(1500 * time.Millisecond):
-		return "", fmt.Errorf("timeout")
+	return v.(*namecoin.NameInfo), nil
+}
+
+func (b *Backend) queryNamecoin(name string) (*namecoin.NameInfo, error) {
+	// We need to return an error response rapidly if we can't query the
+	// backend, well within standard DNS timeouts.
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.NamecoinTimeout)
+	defer cancel()
+
+	info, err := b.nc.Query(ctx, name)
+	if err != nil {
+		if err != merr.ErrNoSuchDomain {
+			log.Errore(err, "failed to query namecoin")
+		}
+		return nil, err
+	}
+
+	info, err = b.confirmedValue(ctx, name, info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.checkExpired(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Given the current value of a name, returns its most recent value which has
+// the minimum number of confirmations, retrieving the name's history if
+// necessary. Returns merr.ErrNoSuchDomain if the name had no such value.
+func (b *Backend) confirmedValue(ctx context.Context, name string, info *namecoin.NameInfo) (*namecoin.NameInfo, error) {
+	maxHeight, err := b.maxConfirmedHeight(ctx)
+	if err != nil || info.Height <= maxHeight {
+		return info, err
 	}
+
+	log.Infof("%s was updated at height %d, which has too few confirmations; using its previous value", name, info.Height)
+
+	history, err := b.nc.History(ctx, name)
+	if err != nil {
+		log.Errore(err, "failed to query namecoin name history")
+		return nil, err
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+		if h.Height > maxHeight {
+			continue
+		}
+
+		// If the previous value had already expired as of maxHeight, the name
+		// didn't exist then. expires_in is relative to the current height,
+		// which is MinConfirmations-1 blocks after maxHeight.
+		if !b.cfg.ServeExpired && h.ExpiresIn <= -(b.cfg.MinConfirmations-1) {
+			return nil, merr.ErrNoSuchDomain
+		}
+
+		// The name itself expires according to its current value.
+		h.Expired = info.Expired
+		h.ExpiresIn = info.ExpiresIn
+		return &h, nil
+	}
+
+	return nil, merr.ErrNoSuchDomain
+}
+
+// Returns the height of the most recent block whose names have the minimum
+// number of confirmations. If no minimum is configured, this is arbitrarily
+// large.
+func (b *Backend) maxConfirmedHeight(ctx context.Context) (int, error) {
+	if b.cfg.MinConfirmations <= 1 {
+		return int(^uint(0) >> 1), nil
+	}
+
+	height, err := b.curHeight(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return height - b.cfg.MinConfirmations + 1, nil
+}
+
+// Returns the current block height, which is cached briefly. Failures to
+// retrieve it are also cached, so that lookups don't each wait for Namecoin
+// while it is unavailable.
+func (b *Backend) curHeight(ctx context.Context) (int, error) {
+	b.heightMutex.Lock()
+	if time.Now().Before(b.heightExpire) {
+		height, err := b.height, b.heightErr
+		b.heightMutex.Unlock()
+		return height, err
+	}
+	b.heightMutex.Unlock()
+
+	height, err := b.nc.CurHeight(ctx)
+
+	b.heightMutex.Lock()
+	defer b.heightMutex.Unlock()
+
+	b.heightExpire = time.Now().Add(heightCacheMaxAge)
+	if err != nil {
+		log.Errore(err, "failed to query namecoin block height")
+		b.height, b.heightErr = 0, err
+		return 0, err
+	}
+
+	b.setHeightLocked(height)
+	return height, nil
+}
+
+// Informs the backend of the current block height, as determined elsewhere.
+func (b *Backend) SetBlockHeight(height int) {
+	b.heightMutex.Lock()
+	defer b.heightMutex.Unlock()
+
+	b.setHeightLocked(height)
+}
+
+// Caches the current block height and, unless the serial is set externally,
+// advances the SOA serial to it. Must be called with heightMutex held.
+func (b *Backend) setHeightLocked(height int) {
+	b.height, b.heightErr = height, nil
+	b.heightExpire = time.Now().Add(heightCacheMaxAge)
+
+	if !b.cfg.ExternalSerial && uint32(height) > b.serial {
+		b.serial = uint32(height)
+	}
+}
+
+// Expired names do not exist unless configured otherwise.
+func (b *Backend) checkExpired(info *namecoin.NameInfo) error {
+	if info.Expired && !b.cfg.ServeExpired {
+		return merr.ErrNoSuchDomain
+	}
+
+	return nil
 }
 
 func (b *Backend) jsonToDomain(name, jsonValue string) (*domain, error) {
-	d := &domain{}
+	d := &domain{
+		deps: map[string]struct{}{},
+	}
+
+	// Record every name referenced via "import" or "delegate", whether or not
+	// it could be resolved, so that the value can be invalidated when any of
+	// them changes.
+	prefetched := b.prefetchNames(jsonValue)
+	resolve := func(depName string) (string, error) {
+		d.deps[depName] = struct{}{}
+		if r, ok := prefetched[depName]; ok {
+			return r.Value, r.Err
+		}
+
+		return b.resolveExtraName(depName)
+	}
 
-	v := ncdomain.ParseValue(name, jsonValue, b.resolveExtraName, nil)
+	errFunc := func(err error, isWarning bool) {
+		d.parseErrors = append(d.parseErrors, ParseError{
+			Message:   err.Error(),
+			IsWarning: isWarning,
+		})
+
+		if isWarning {
+			log.Infof("warning in value of %s: %v", name, err)
+		} else {
+			log.Warnf("error in value of %s: %v", name, err)
+		}
+	}
+
+	v := ncdomain.ParseValue(name, jsonValue, resolve, errFunc)
 	if v == nil {
-		return nil, fmt.Errorf("couldn't parse value")
+		return nil, &valueError{name, "couldn't parse value"}
 	}
 
+	b.filterAddresses(d, name, v, "")
+
 	d.ncv = v
+	d.expire = time.Now().Add(b.maxAgeForValue(v))
 
 	return d, nil
 }
 
+// Removes denied addresses from a value and the values in its map. Each
+// address removed is logged and recorded as a warning for the domain. subname
+// is the name of the value relative to the domain, e.g. "www.".
+func (b *Backend) filterAddresses(d *domain, name string, v *ncdomain.Value, subname string) {
+	if len(b.deniedNetworks) == 0 {
+		return
+	}
+
+	filter := func(ips []net.IP) []net.IP {
+		var out []net.IP
+		for _, ip := range ips {
+			if !b.addressDenied(ip) {
+				out = append(out, ip)
+				continue
+			}
+
+			at := "@"
+			if subname != "" {
+				at = strings.TrimSuffix(subname, ".")
+			}
+
+			msg := fmt.Sprintf("removed denied address %v at %s", ip, at)
+			log.Infof("%s: %s", name, msg)
+			d.parseErrors = append(d.parseErrors, ParseError{
+				Message:   msg,
+				IsWarning: true,
+			})
+		}
+		return out
+	}
+
+	v.IP = filter(v.IP)
+	v.IP6 = filter(v.IP6)
+
+	for label, sub := range v.Map {
+		b.filterAddresses(d, name, sub, label+"."+subname)
+	}
+}
+
+// Returns true if the address is within a denied network and not within an
+// allowed one.
+func (b *Backend) addressDenied(ip net.IP) bool {
+	for _, n := range b.cfg.AllowedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, n := range b.deniedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Networks containing private, loopback, link-local and other reserved
+// addresses, which are denied if DenyReservedAddresses is set.
+var reservedNetworks = mustParseNetworks(
+	"0.0.0.0/8",       // "This" network (RFC 1122)
+	"10.0.0.0/8",      // Private (RFC 1918)
+	"100.64.0.0/10",   // Shared address space (RFC 6598)
+	"127.0.0.0/8",     // Loopback (RFC 1122)
+	"169.254.0.0/16",  // Link-local (RFC 3927)
+	"172.16.0.0/12",   // Private (RFC 1918)
+	"192.0.0.0/24",    // IETF protocol assignments (RFC 6890)
+	"192.0.2.0/24",    // Documentation (RFC 5737)
+	"192.168.0.0/16",  // Private (RFC 1918)
+	"198.18.0.0/15",   // Benchmarking (RFC 2544)
+	"198.51.100.0/24", // Documentation (RFC 5737)
+	"203.0.113.0/24",  // Documentation (RFC 5737)
+	"224.0.0.0/4",     // Multicast (RFC 5771)
+	"240.0.0.0/4",     // Reserved and broadcast (RFC 1112, RFC 919)
+	"::/128",          // Unspecified (RFC 4291)
+	"::1/128",         // Loopback (RFC 4291)
+	"100::/64",        // Discard-only (RFC 6666)
+	"2001:db8::/32",   // Documentation (RFC 3849)
+	"fc00::/7",        // Unique local (RFC 4193)
+	"fe80::/10",       // Link-local (RFC 4291)
+	"fec0::/10",       // Site-local, deprecated (RFC 3879)
+	"ff00::/8",        // Multicast (RFC 4291)
+)
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Returns the first error (not warning) produced when parsing the domain's
+// value, or nil if there were none.
+func (d *domain) firstError() *ParseError {
+	for i := range d.parseErrors {
+		if !d.parseErrors[i].IsWarning {
+			return &d.parseErrors[i]
+		}
+	}
+
+	return nil
+}
+
+// Applies the ParseErrorPolicy to a domain. Returns merr.ErrNoSuchDomain or
+// an error describing the first error in its value if it should not be
+// served.
+func (b *Backend) checkParseErrors(name string, d *domain) error {
+	perr := d.firstError()
+	if perr == nil {
+		return nil
+	}
+
+	switch b.cfg.ParseErrorPolicy {
+	case ParseErrorServfail:
+		return &valueError{name, perr.Message}
+	case ParseErrorNXDomain:
+		return merr.ErrNoSuchDomain
+	default:
+		return nil
+	}
+}
+
+// Returns the errors and warnings produced when parsing the values of the
+// names currently cached, for the names which had any.
+func (b *Backend) ParseErrors() map[string][]ParseError {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	m := make(map[string][]ParseError, len(b.parseErrors))
+	for name, errs := range b.parseErrors {
+		m[name] = errs
+	}
+
+	return m
+}
+
+// Determines how long a parsed value may be cached for. This is the
+// configured maximum cache age, or the lowest TTL of any record generated from
+// the value if that is lower.
+func (b *Backend) maxAgeForValue(v *ncdomain.Value) time.Duration {
+	maxAge := b.cfg.CacheMaxAge
+
+	rrs, _ := v.RRsRecursive(nil, "bit.", "bit.")
+	for _, rr := range rrs {
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if ttl < maxAge {
+			maxAge = ttl
+		}
+	}
+
+	return maxAge
+}
+
+// Retrieves the values of the names referenced by the given value via "import"
+// or "delegate", and of the names referenced by those in turn, using a batch
+// request for each level of references. Names which could not be retrieved in
+// this way are absent from the map returned and should be retrieved
+// individually.
+func (b *Backend) prefetchNames(jsonValue string) map[string]namecoin.QueryResult {
+	prefetched := map[string]namecoin.QueryResult{}
+	values := []string{jsonValue}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.NamecoinTimeout)
+	defer cancel()
+
+	maxHeight, err := b.maxConfirmedHeight(ctx)
+	if err != nil {
+		return prefetched
+	}
+
+	for depth := 0; depth < prefetchDepth && len(values) > 0; depth++ {
+		var names []string
+		for _, v := range values {
+			for _, name := range ncdomain.ReferencedNames(v) {
+				if _, ok := prefetched[name]; ok {
+					continue
+				}
+				if _, ok := b.cfg.FakeNames[name]; ok {
+					continue
+				}
+
+				prefetched[name] = namecoin.QueryResult{}
+				names = append(names, name)
+			}
+		}
+
+		if len(names) == 0 {
+			break
+		}
+
+		results, err := b.nc.QueryMany(ctx, names)
+		if err != nil {
+			log.Warne(err, "failed to query namecoin (batch)")
+			for _, name := range names {
+				delete(prefetched, name)
+			}
+			break
+		}
+
+		values = values[0:0]
+		for i, name := range names {
+			// Names with too few confirmations are retrieved individually, as
+			// their history is needed.
+			if results[i].Err == nil && results[i].Height > maxHeight {
+				delete(prefetched, name)
+				continue
+			}
+
+			if results[i].Err == nil {
+				results[i].Err = b.checkExpired(&results[i].NameInfo)
+			}
+
+			prefetched[name] = results[i]
+			if results[i].Err == nil {
+				values = append(values, results[i].Value)
+			}
+		}
+	}
+
+	return prefetched
+}
+
 func (b *Backend) resolveExtraName(name string) (jsonValue string, err error) {
-	return b.resolveName(name)
+	info, err := b.resolveName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return info.Value, nil
 }
 
 func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
@@ -377,11 +1480,55 @@ func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
 		err = nil
 	}
 
+	// If enabled, each Namecoin domain is given an SOA of its own, unless it
+	// is delegated elsewhere. A CNAME can't coexist with an SOA, so domains
+	// using alias at their apex are not.
+	if err == nil && tx.b.cfg.DomainSOA && tx.subname == "" && len(d.ncv.NS) == 0 && !d.ncv.HasAlias {
+		rrs = append([]dns.RR{tx.domainSOA(d)}, rrs...)
+	}
+
 	return
 }
 
+// Returns the SOA for the apex of a Namecoin domain. The RNAME is taken from
+// the domain's hostmaster item, if it has a valid one, and the serial is the
+// block height at which the name was last updated.
+func (tx *btx) domainSOA(d *domain) *dns.SOA {
+	mbox := tx.b.cfg.Hostmaster
+	if d.ncv.Hostmaster != "" {
+		hm, err := convertEmail(d.ncv.Hostmaster)
+		if err == nil {
+			mbox = hm
+		}
+	}
+
+	serial := uint32(d.height)
+	if serial == 0 {
+		serial = 1
+	}
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(tx.basename + "." + tx.rootname),
+			Ttl:    seconds(tx.b.cfg.SOAMinimum),
+			Class:  dns.ClassINET,
+			Rrtype: dns.TypeSOA,
+		},
+		Ns:      tx.nameservers()[0],
+		Mbox:    mbox,
+		Serial:  serial,
+		Refresh: seconds(tx.b.cfg.SOARefresh),
+		Retry:   seconds(tx.b.cfg.SOARetry),
+		Expire:  seconds(tx.b.cfg.SOAExpire),
+		Minttl:  seconds(tx.b.cfg.SOAMinimum),
+	}
+}
+
 func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs []dns.RR, err error) {
 	ncv, sn, err := tx.findNCValue(rncv, subname, nil /*hasNS*/)
+	if err == errBelowDNAME {
+		return tx.addAnswersBelowDNAME(ncv, sn)
+	}
 	if err != nil {
 		return
 	}
@@ -389,6 +1536,54 @@ func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs
 	return tx.addAnswersUnderNCValueActual(ncv, sn)
 }
 
+// Returned by _findNCValue when the query name is below a value with a
+// translate item, along with that value.
+var errBelowDNAME = fmt.Errorf("query name is below a DNAME")
+
+// Returns the DNAME for a query below a value with a translate item, along
+// with the CNAME synthesized from it as described in RFC 6672, for the sake of
+// resolvers which don't understand DNAME. If the target of the CNAME is in the
+// zone, the server follows it.
+func (tx *btx) addAnswersBelowDNAME(ncv *ncdomain.Value, sn string) (rrs []dns.RR, err error) {
+	owner := dns.Fqdn(sn + tx.basename + "." + tx.rootname)
+	ownerRRs, err := ncv.RRs(nil, owner, dns.Fqdn(tx.basename+"."+tx.rootname))
+	if err != nil {
+		return nil, err
+	}
+
+	qname := dns.Fqdn(tx.qname)
+	for _, rr := range ownerRRs {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+
+		// The query name is known to be below the owner of the DNAME, so its
+		// labels before the owner's are substituted onto the target.
+		prefix := qname[:len(qname)-len(owner)]
+		target := prefix + dname.Target
+		if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+			return nil, fmt.Errorf("DNAME substitution for %s produces an overlong name", qname)
+		}
+
+		rrs = append(rrs, dname, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    dname.Hdr.Ttl,
+			},
+			Target: target,
+		})
+	}
+
+	if len(rrs) == 0 {
+		return nil, merr.ErrNoSuchDomain
+	}
+
+	return rrs, nil
+}
+
 func (tx *btx) findNCValue(ncv *ncdomain.Value, subname string, shortCircuitFunc func(curNCV *ncdomain.Value) bool) (xncv *ncdomain.Value, sn string, err error) {
 	return tx._findNCValue(ncv, subname, "", 0, shortCircuitFunc)
 }
@@ -401,14 +1596,33 @@ func (tx *btx) _findNCValue(ncv *ncdomain.Value, isubname, subname string, depth
 	}
 
 	if isubname != "" {
+		// Names below a value with a translate item are redirected by its
+		// DNAME, regardless of the value's map. A delegation takes precedence
+		// over the translate item.
+		if shortCircuitFunc == nil && ncv.HasTranslate && len(ncv.NS) == 0 {
+			return ncv, subname, errBelowDNAME
+		}
+
 		head, rest := util.SplitDomainHead(isubname)
 
 		sub, ok := ncv.Map[head]
 		if !ok {
+			// As described in RFC 4592, a wildcard matches only if the name
+			// closest to the query name which exists is its parent. It then
+			// matches all of the remaining labels, and the wildcard's own map
+			// is not used. Any existing name, including an empty non-terminal,
+			// blocks the wildcard, as it is found in the map above instead.
+			// The answer is synthesized with the query name as its owner.
 			sub, ok = ncv.Map["*"]
 			if !ok {
 				return nil, "", merr.ErrNoSuchDomain
 			}
+
+			if shortCircuitFunc != nil && !shortCircuitFunc(sub) {
+				return nil, "", merr.ErrNoSuchDomain
+			}
+
+			return sub, "*." + subname, nil
 		}
 		return tx._findNCValue(sub, rest, head+"."+subname, depth+1, shortCircuitFunc)
 	}
@@ -0,0 +1,504 @@
+package backend_test
+
+import "github.com/namecoin/ncdns/backend"
+import "github.com/namecoin/ncdns/namecoin"
+import "github.com/miekg/dns"
+import "gopkg.in/hlandau/madns.v1/merr"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+const wildcardValue = `{
+  "ip": "192.0.2.1",
+  "map": {
+    "*": {
+      "ip": "192.0.2.2",
+      "map": {
+        "mail": { "ip": "192.0.2.3" }
+      }
+    },
+    "www": { "ip": "192.0.2.4" },
+    "sub": {
+      "map": {
+        "deep": { "ip": "192.0.2.5" }
+      }
+    }
+  }
+}`
+
+var wildcardTests = []struct {
+	qname string
+	addrs []string // nil means NXDOMAIN
+}{
+	// The wildcard matches names which don't exist, including those more than
+	// one label below it.
+	{"foo.example.bit.", []string{"192.0.2.2"}},
+	{"a.b.example.bit.", []string{"192.0.2.2"}},
+
+	// Names which exist are not affected by the wildcard, nor are names below
+	// them.
+	{"example.bit.", []string{"192.0.2.1"}},
+	{"www.example.bit.", []string{"192.0.2.4"}},
+	{"x.www.example.bit.", nil},
+
+	// An empty non-terminal exists, and so blocks the wildcard.
+	{"sub.example.bit.", []string{}},
+	{"x.sub.example.bit.", nil},
+	{"deep.sub.example.bit.", []string{"192.0.2.5"}},
+
+	// The wildcard's own map is only used for queries for those names
+	// literally.
+	{"*.example.bit.", []string{"192.0.2.2"}},
+	{"mail.*.example.bit.", []string{"192.0.2.3"}},
+	{"mail.foo.example.bit.", []string{"192.0.2.2"}},
+}
+
+// Creates a backend which serves the given names instead of querying
+// namecoind, configured otherwise by cfg, which may be nil.
+func newFakeBackend(t *testing.T, names map[string]string, cfg *backend.Config) *backend.Backend {
+	if cfg == nil {
+		cfg = &backend.Config{}
+	}
+	cfg.FakeNames = names
+
+	b, err := backend.New(cfg)
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+
+	return b
+}
+
+func TestWildcards(t *testing.T) {
+	b := newFakeBackend(t, map[string]string{
+		"d/example": wildcardValue,
+	}, nil)
+
+	for _, tt := range wildcardTests {
+		rrs, err := b.Lookup(tt.qname)
+		if tt.addrs == nil {
+			if err != merr.ErrNoSuchDomain {
+				t.Errorf("%s: expected NXDOMAIN, got %v, %v", tt.qname, rrs, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.qname, err)
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range rrs {
+			a, ok := rr.(*dns.A)
+			if !ok {
+				continue
+			}
+
+			// Synthesized records are owned by the query name.
+			if a.Hdr.Name != tt.qname {
+				t.Errorf("%s: record has wrong owner: %v", tt.qname, a)
+			}
+
+			addrs = append(addrs, a.A.String())
+		}
+
+		if len(addrs) != len(tt.addrs) {
+			t.Errorf("%s: expected %v, got %v", tt.qname, tt.addrs, addrs)
+			continue
+		}
+
+		for i := range addrs {
+			if addrs[i] != tt.addrs[i] {
+				t.Errorf("%s: expected %v, got %v", tt.qname, tt.addrs, addrs)
+				break
+			}
+		}
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	b := newFakeBackend(t, map[string]string{
+		"d/example": `{"ip": ["127.0.0.1", "198.51.100.1", "203.0.113.1"], "ip6": ["fe80::1", "2001:db8::1"], "map": {"www": {"ip": "10.0.0.1"}}}`,
+	}, &backend.Config{
+		DenyReservedAddresses: true,
+		AllowedNetworks:       mustParseCIDR(t, "198.51.100.0/24"),
+	})
+
+	rrs, err := b.Lookup("example.bit.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var addrs []string
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, v.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, v.AAAA.String())
+		}
+	}
+
+	if len(addrs) != 1 || addrs[0] != "198.51.100.1" {
+		t.Errorf("expected only the allowed address, got %v", addrs)
+	}
+
+	rrs, err = b.Lookup("www.example.bit.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.A); ok {
+			t.Errorf("private address was not removed: %v", rr)
+		}
+	}
+
+	if n := len(b.ParseErrors()["d/example"]); n != 5 {
+		t.Errorf("expected 5 removed addresses to be recorded, got %d", n)
+	}
+}
+
+func mustParseCIDR(t *testing.T, cidr string) []*net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("couldn't parse %s: %v", cidr, err)
+	}
+
+	return []*net.IPNet{n}
+}
+
+// A fake namecoind which serves a single name until it is made to fail.
+type fakeNamecoind struct {
+	failing  int32
+	requests int32
+}
+
+func (f *fakeNamecoind) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&f.requests, 1)
+	if atomic.LoadInt32(&f.failing) != 0 {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write([]byte(`{"result": {"name": "d/example", "value": "{\"ip\": \"192.0.2.1\"}", "height": 100, "expires_in": 1000}, "error": null, "id": 1}`))
+}
+
+func TestStaleRefreshRate(t *testing.T) {
+	f := &fakeNamecoind{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	b := newFakeBackend(t, nil, &backend.Config{
+		NamecoinConn: namecoin.Conn{
+			Server: strings.TrimPrefix(srv.URL, "http://"),
+		},
+		CacheMaxAge: time.Millisecond,
+		StaleMaxAge: time.Hour,
+	})
+
+	_, err := b.Lookup("example.bit.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ee := b.StaleError("www.example.bit."); ee != nil {
+		t.Errorf("unexpected extended error for fresh value: %v", ee)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if ee := b.StaleError("www.example.bit."); ee == nil || ee.InfoCode != backend.EDEStaleAnswer {
+		t.Errorf("expected stale answer error, got %v", ee)
+	}
+
+	atomic.StoreInt32(&f.failing, 1)
+	atomic.StoreInt32(&f.requests, 0)
+
+	for i := 0; i < 20; i++ {
+		_, err = b.Lookup("example.bit.")
+		if err != nil {
+			t.Fatalf("stale value was not served: %v", err)
+		}
+	}
+
+	// Give any background refreshes time to reach the server.
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&f.requests); n != 1 {
+		t.Errorf("expected one attempt to refresh the name, got %d", n)
+	}
+}
+
+func TestDomainSOA(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		b := newFakeBackend(t, map[string]string{
+			"d/example": `{"ip": "192.0.2.1", "email": "hostmaster@example.com"}`,
+		}, &backend.Config{
+			DomainSOA: enabled,
+		})
+
+		rrs, err := b.Lookup("example.bit.")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var soa *dns.SOA
+		for _, rr := range rrs {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+			}
+		}
+
+		if (soa != nil) != enabled {
+			t.Errorf("domainsoa=%v: got SOA %v", enabled, soa)
+		} else if soa != nil && soa.Mbox != "hostmaster.example.com." {
+			t.Errorf("SOA does not use the domain's hostmaster: %v", soa)
+		}
+	}
+}
+
+func TestLookupExtended(t *testing.T) {
+	b := newFakeBackend(t, map[string]string{
+		"d/example": `{"ip": "192.0.2.1"}`,
+		"d/invalid": `{"ip": "not an address"}`,
+		"d/missing": "NX",
+	}, &backend.Config{
+		ParseErrorPolicy: backend.ParseErrorServfail,
+		UnsyncedPolicy:   backend.UnsyncedServfail,
+	})
+
+	tests := []struct {
+		qname    string
+		infoCode int // -1 means no extended error
+	}{
+		{"example.bit.", -1},
+		{"www.example.bit.", -1},
+		{"bit.", -1},
+		{"invalid.bit.", backend.EDEInvalidData},
+		{"missing.bit.", backend.EDEOther},
+	}
+
+	for _, tt := range tests {
+		_, ee, _ := b.LookupExtended(tt.qname)
+		if tt.infoCode < 0 {
+			if ee != nil {
+				t.Errorf("%s: unexpected extended error %v", tt.qname, ee)
+			}
+			continue
+		}
+
+		if ee == nil || int(ee.InfoCode) != tt.infoCode {
+			t.Errorf("%s: expected info code %d, got %v", tt.qname, tt.infoCode, ee)
+		}
+	}
+
+	b.SetSynced(false)
+	if _, ee, err := b.LookupExtended("example.bit."); err == nil || ee == nil || ee.InfoCode != backend.EDENotReady {
+		t.Errorf("expected unsynced error, got %v, %v", ee, err)
+	}
+}
+
+// A label of the maximum length.
+var longLabel = strings.Repeat("a", 63)
+
+var dnameValue = `{
+  "ip": "192.0.2.1",
+  "map": {
+    "www": { "alias": "example.com." },
+    "old": { "translate": "new.example.bit." },
+    "long": { "translate": "` + longLabel + `.` + longLabel + `.` + longLabel + `.example.com." }
+  }
+}`
+
+var dnameTests = []struct {
+	qname string
+	dname string // expected DNAME target, if any
+	cname string // expected CNAME target, if any
+	err   bool
+}{
+	// alias yields a CNAME.
+	{"www.example.bit.", "", "example.com.", false},
+
+	// translate yields a DNAME at its owner, and a CNAME is synthesized for
+	// names below it.
+	{"old.example.bit.", "new.example.bit.", "", false},
+	{"x.old.example.bit.", "new.example.bit.", "x.new.example.bit.", false},
+	{"a.b.old.example.bit.", "new.example.bit.", "a.b.new.example.bit.", false},
+
+	// A substitution which would produce a name longer than 255 octets fails.
+	{"b.long.example.bit.", longLabel + "." + longLabel + "." + longLabel + ".example.com.", "b." + longLabel + "." + longLabel + "." + longLabel + ".example.com.", false},
+	{longLabel + ".long.example.bit.", "", "", true},
+}
+
+func TestDNAME(t *testing.T) {
+	b := newFakeBackend(t, map[string]string{
+		"d/example": dnameValue,
+	}, nil)
+
+	for _, tt := range dnameTests {
+		rrs, err := b.Lookup(tt.qname)
+		if tt.err {
+			if err == nil || err == merr.ErrNoSuchDomain {
+				t.Errorf("%s: expected error, got %v, %v", tt.qname, rrs, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.qname, err)
+			continue
+		}
+
+		var dname, cname string
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.DNAME:
+				dname = v.Target
+			case *dns.CNAME:
+				// Synthesized CNAMEs are owned by the query name.
+				if v.Hdr.Name != tt.qname {
+					t.Errorf("%s: CNAME has wrong owner: %v", tt.qname, v)
+				}
+				cname = v.Target
+			}
+		}
+
+		if dname != tt.dname || cname != tt.cname {
+			t.Errorf("%s: expected DNAME %q and CNAME %q, got %q and %q", tt.qname, tt.dname, tt.cname, dname, cname)
+		}
+	}
+}
+
+func TestGlue(t *testing.T) {
+	b := newFakeBackend(t, map[string]string{
+		"d/example": `{"ns": ["ns1.example.bit."], "map": {"ns1": {"ip": "192.0.2.53", "ip6": "2001:db8::53"}}}`,
+	}, nil)
+
+	rrs, err := b.Glue("ns1.example.bit.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var addrs []string
+	for _, rr := range rrs {
+		if rr.Header().Name != "ns1.example.bit." {
+			t.Errorf("glue has wrong owner: %v", rr)
+		}
+
+		switch v := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, v.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, v.AAAA.String())
+		}
+	}
+
+	if len(addrs) != 2 || addrs[0] != "192.0.2.53" || addrs[1] != "2001:db8::53" {
+		t.Errorf("expected both addresses as glue, got %v", addrs)
+	}
+
+	for _, name := range []string{"nx.example.bit.", "nx.ns1.example.bit.", "example.com."} {
+		if _, err := b.Glue(name); err != merr.ErrNoSuchDomain {
+			t.Errorf("%s: expected no glue, got %v", name, err)
+		}
+	}
+}
+
+func TestSOASerial(t *testing.T) {
+	serial := func(b *backend.Backend) uint32 {
+		rrs, err := b.Lookup("bit.")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Serial
+			}
+		}
+
+		t.Fatalf("no SOA at zone apex")
+		return 0
+	}
+
+	b := newFakeBackend(t, nil, nil)
+	b.SetBlockHeight(100)
+	b.SetBlockHeight(99)
+	if s := serial(b); s != 100 {
+		t.Errorf("expected serial to follow the block height, got %d", s)
+	}
+
+	// The serial of a zone maintained for transfers is not affected by the
+	// block height.
+	b = newFakeBackend(t, nil, &backend.Config{ExternalSerial: true})
+	b.SetBlockHeight(100)
+	b.AdvanceSerial(95)
+	if s := serial(b); s != 95 {
+		t.Errorf("expected serial 95, got %d", s)
+	}
+}
+
+// Returns the IPv4 addresses served for qname.
+func lookupAddrs(t *testing.T, b *backend.Backend, qname string) []string {
+	rrs, err := b.Lookup(qname)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", qname, err)
+	}
+
+	var addrs []string
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+
+	return addrs
+}
+
+func TestImportInvalidation(t *testing.T) {
+	names := map[string]string{
+		"d/example": `{"import": "d/target"}`,
+		"d/target":  `{"ip": "192.0.2.1"}`,
+	}
+	b := newFakeBackend(t, names, nil)
+
+	if addrs := lookupAddrs(t, b, "example.bit."); strings.Join(addrs, " ") != "192.0.2.1" {
+		t.Fatalf("expected imported address, got %v", addrs)
+	}
+
+	// The importing name is cached until the name it imports is updated.
+	names["d/target"] = `{"ip": "192.0.2.2"}`
+	if addrs := lookupAddrs(t, b, "example.bit."); strings.Join(addrs, " ") != "192.0.2.1" {
+		t.Errorf("expected cached address, got %v", addrs)
+	}
+
+	b.InvalidateName("d/target")
+	if addrs := lookupAddrs(t, b, "example.bit."); strings.Join(addrs, " ") != "192.0.2.2" {
+		t.Errorf("importing name was not invalidated with the name it imports: got %v", addrs)
+	}
+}
+
+func TestImportEviction(t *testing.T) {
+	names := map[string]string{
+		"d/example": `{"import": "d/target"}`,
+		"d/target":  `{"ip": "192.0.2.1"}`,
+		"d/other":   `{"ip": "192.0.2.3"}`,
+	}
+	b := newFakeBackend(t, names, &backend.Config{CacheMaxEntries: 2})
+
+	lookupAddrs(t, b, "target.bit.")
+	lookupAddrs(t, b, "example.bit.")
+	names["d/target"] = `{"ip": "192.0.2.2"}`
+
+	// Caching another name evicts the least recently used, d/target, which
+	// also evicts d/example as it imports d/target.
+	lookupAddrs(t, b, "other.bit.")
+	if addrs := lookupAddrs(t, b, "example.bit."); strings.Join(addrs, " ") != "192.0.2.2" {
+		t.Errorf("importing name was not evicted with the name it imports: got %v", addrs)
+	}
+}
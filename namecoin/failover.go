@@ -0,0 +1,139 @@
+package namecoin
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A set of Namecoin JSON-RPC servers between which requests fail over.
+//
+// Each request is sent to the healthy server with the highest block height,
+// which is given all of the time remaining for the request. If it fails, the
+// next best server is tried, and so on. Servers are marked unhealthy when a
+// request to them fails or a health check (see CheckHealth) fails, and healthy
+// again once a health check succeeds. Use an EndpointSet by setting the
+// Endpoints field of a Conn.
+type EndpointSet struct {
+	mutex     sync.Mutex
+	endpoints []*endpoint
+}
+
+type endpoint struct {
+	conn    Conn
+	healthy bool
+	height  int
+}
+
+// Creates a new endpoint set. Each server is described by a Conn, the
+// Endpoints field of which is ignored. Where servers are otherwise equally
+// preferable, those earlier in the list are preferred.
+func NewEndpointSet(conns []Conn) *EndpointSet {
+	es := &EndpointSet{}
+	for _, c := range conns {
+		c.Endpoints = nil
+		es.endpoints = append(es.endpoints, &endpoint{
+			conn:    c,
+			healthy: true,
+		})
+	}
+
+	return es
+}
+
+// Checks the health of each server by querying its block height. Each check
+// is given the specified timeout.
+func (es *EndpointSet) CheckHealth(timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, ep := range es.endpoints {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			height, err := ep.conn.CurHeight(ctx)
+			es.setHealth(ep, height, err)
+		}(ep)
+	}
+
+	wg.Wait()
+}
+
+// Calls CheckHealth at the given interval. Does not return.
+func (es *EndpointSet) RunHealthChecks(interval, timeout time.Duration) {
+	for {
+		es.CheckHealth(timeout)
+		time.Sleep(interval)
+	}
+}
+
+func (es *EndpointSet) setHealth(ep *endpoint, height int, err error) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	if err != nil {
+		if ep.healthy {
+			log.Warne(err, "Namecoin RPC server ", ep.conn.Server, " is unhealthy")
+		}
+		ep.healthy = false
+		return
+	}
+
+	if !ep.healthy {
+		log.Info("Namecoin RPC server ", ep.conn.Server, " is healthy again")
+	}
+	ep.healthy = true
+	ep.height = height
+}
+
+// Returns the endpoints in the order in which they should be tried.
+func (es *EndpointSet) ordered() []*endpoint {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	eps := make(byPreference, len(es.endpoints))
+	copy(eps, es.endpoints)
+	sort.Stable(eps)
+	return eps
+}
+
+type byPreference []*endpoint
+
+func (p byPreference) Len() int      { return len(p) }
+func (p byPreference) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPreference) Less(i, j int) bool {
+	if p[i].healthy != p[j].healthy {
+		return p[i].healthy
+	}
+
+	return p[i].height > p[j].height
+}
+
+// Sends a request to each server in turn until one succeeds. A server which
+// doesn't respond before the deadline is marked unhealthy, so that later
+// requests try the others first, but there is no time left to try them for
+// this request.
+func (es *EndpointSet) post(ctx context.Context, msg []byte) (body []byte, err error) {
+	for _, ep := range es.ordered() {
+		body, err = ep.conn.post(ctx, msg)
+		if err == nil {
+			return
+		}
+
+		// If the caller gave up, that isn't necessarily the server's fault.
+		if ctx.Err() == context.Canceled {
+			return
+		}
+
+		es.setHealth(ep, 0, err)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	return
+}
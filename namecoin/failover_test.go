@@ -0,0 +1,104 @@
+package namecoin
+
+import (
+	"context"
+	"gopkg.in/hlandau/madns.v1/merr"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const nameShowReply = `{"result": {"name": "d/example", "value": "{}", "height": 100, "expires_in": 1000}, "error": null, "id": 1}`
+
+// Returns a server which hangs until the request is abandoned.
+func hangingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The request isn't abandoned until the server notices the
+		// connection closing, which it only watches for once the request
+		// has been read.
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+	}))
+}
+
+// Returns a server which responds to every request with the given status and
+// body.
+func replyingServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+}
+
+func newTestEndpointSet(servers ...*httptest.Server) *EndpointSet {
+	var conns []Conn
+	for _, srv := range servers {
+		conns = append(conns, Conn{Server: strings.TrimPrefix(srv.URL, "http://")})
+	}
+
+	return NewEndpointSet(conns)
+}
+
+func TestFailover(t *testing.T) {
+	good := replyingServer(http.StatusOK, nameShowReply)
+	defer good.Close()
+
+	tests := []struct {
+		name    string
+		primary *httptest.Server
+	}{
+		{"warming up", replyingServer(http.StatusInternalServerError, `{"result": null, "error": {"code": -28, "message": "Loading block index..."}, "id": 1}`)},
+		{"HTTP error", replyingServer(http.StatusBadGateway, "<html>Bad Gateway</html>")},
+		{"hanging", hangingServer()},
+	}
+
+	for _, tt := range tests {
+		es := newTestEndpointSet(tt.primary, good)
+		nc := Conn{Endpoints: es}
+
+		// A server which doesn't respond in time uses up the time for the
+		// request, but is avoided by later requests.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := nc.Query(ctx, "d/example")
+		cancel()
+		if err != nil && tt.name != "hanging" {
+			t.Errorf("%s: request did not fail over: %v", tt.name, err)
+		}
+
+		if es.endpoints[0].healthy {
+			t.Errorf("%s: primary server was not marked unhealthy", tt.name)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = nc.Query(ctx, "d/example")
+		cancel()
+		if err != nil {
+			t.Errorf("%s: unexpected error after failing over: %v", tt.name, err)
+		}
+
+		tt.primary.Close()
+	}
+}
+
+func TestFailoverRPCError(t *testing.T) {
+	// Errors relating to the request are not failures of the server.
+	primary := replyingServer(http.StatusInternalServerError, `{"result": null, "error": {"code": -4, "message": "name not found"}, "id": 1}`)
+	defer primary.Close()
+	secondary := replyingServer(http.StatusOK, nameShowReply)
+	defer secondary.Close()
+
+	es := newTestEndpointSet(primary, secondary)
+	nc := Conn{Endpoints: es}
+
+	_, err := nc.Query(context.Background(), "d/example")
+	if err != merr.ErrNoSuchDomain {
+		t.Errorf("expected ErrNoSuchDomain, got %v", err)
+	}
+
+	if !es.endpoints[0].healthy {
+		t.Errorf("server was marked unhealthy")
+	}
+}
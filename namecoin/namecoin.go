@@ -3,19 +3,33 @@ package namecoin
 // btcjson had to be modified a bit to get correct error reporting.
 import (
 	extratypes "github.com/hlandau/ncbtcjsontypes"
+	"github.com/hlandau/xlog"
 	"github.com/hlandauf/btcjson"
 	"gopkg.in/hlandau/madns.v1/merr"
 
+	"bytes"
+	"context"
+	"encoding/json"
 	"expvar"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"sync/atomic"
+	"time"
 )
 
+var log, Log = xlog.New("ncdns.namecoin")
+
 var cQueryCalls = expvar.NewInt("ncdns.namecoin.numQueryCalls")
+var cQueryManyCalls = expvar.NewInt("ncdns.namecoin.numQueryManyCalls")
+var cHistoryCalls = expvar.NewInt("ncdns.namecoin.numHistoryCalls")
 var cSyncCalls = expvar.NewInt("ncdns.namecoin.numSyncCalls")
 var cFilterCalls = expvar.NewInt("ncdns.namecoin.numFilterCalls")
 var cScanCalls = expvar.NewInt("ncdns.namecoin.numScanCalls")
 var cCurHeightCalls = expvar.NewInt("ncdns.namecoin.numCurHeightCalls")
+var cCurBlockHashCalls = expvar.NewInt("ncdns.namecoin.numCurBlockHashCalls")
+var cChainInfoCalls = expvar.NewInt("ncdns.namecoin.numChainInfoCalls")
+var cBlockHeaderCalls = expvar.NewInt("ncdns.namecoin.numBlockHeaderCalls")
 
 // Used for generating IDs for JSON-RPC requests.
 var idCounter int32
@@ -26,6 +40,9 @@ func newID() int32 {
 
 // Used to query a Namecoin JSON-RPC interface. Initialize the struct with a
 // username, password, and address (hostname:port).
+//
+// All methods take a context. Cancelling the context, or letting its deadline
+// pass, aborts the request in progress.
 type Conn struct {
 	Username string
 	Password string
@@ -35,6 +52,29 @@ type Conn struct {
 	GetAuth func() (username, password string, err error)
 
 	Server string
+
+	// The HTTP client used to make requests. If nil, a shared client which
+	// keeps connections to the server alive between requests is used.
+	Client *http.Client
+
+	// If set, requests are sent to the servers in this set, failing over
+	// between them as necessary, and the fields above are ignored.
+	Endpoints *EndpointSet
+}
+
+var defaultClient = &http.Client{
+	Transport: &http.Transport{
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+func (nc *Conn) client() *http.Client {
+	if nc.Client == nil {
+		return defaultClient
+	}
+
+	return nc.Client
 }
 
 func (nc *Conn) getAuth() (username string, password string, err error) {
@@ -45,59 +85,340 @@ func (nc *Conn) getAuth() (username string, password string, err error) {
 	return nc.GetAuth()
 }
 
-func (nc *Conn) rpcSend(cmd btcjson.Cmd) (btcjson.Reply, error) {
-	username, password, err := nc.getAuth()
+func (nc *Conn) rpcSend(ctx context.Context, cmd btcjson.Cmd) (btcjson.Reply, error) {
+	body, err := nc.rpcPost(ctx, cmd)
 	if err != nil {
 		return btcjson.Reply{}, err
 	}
 
-	return btcjson.RpcSend(username, password, nc.Server, cmd)
+	return btcjson.ReadResultCmd(cmd.Method(), body)
+}
+
+// A JSON-RPC request for a method for which btcjson has no command type.
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int32         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// Calls the given JSON-RPC method and unmarshals its result into result.
+func (nc *Conn) rpcCall(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	body, err := nc.rpcPost(ctx, &rpcRequest{
+		JSONRPC: "1.0",
+		ID:      newID(),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *btcjson.Error  `json:"error"`
+	}
+
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("bad reply: %v", err)
+	}
+
+	if r.Error != nil {
+		return r.Error
+	}
+
+	if len(r.Result) == 0 || string(r.Result) == "null" {
+		return fmt.Errorf("got nil result")
+	}
+
+	err = json.Unmarshal(r.Result, result)
+	if err != nil {
+		return fmt.Errorf("bad reply: %v", err)
+	}
+
+	return nil
+}
+
+// Marshals the given request as JSON, posts it to the server and returns the
+// response body.
+func (nc *Conn) rpcPost(ctx context.Context, request interface{}) ([]byte, error) {
+	msg, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if nc.Endpoints != nil {
+		return nc.Endpoints.post(ctx, msg)
+	}
+
+	return nc.post(ctx, msg)
+}
+
+func (nc *Conn) post(ctx context.Context, msg []byte) ([]byte, error) {
+	username, password, err := nc.getAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", "http://"+nc.Server, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := nc.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("authentication failed: %s", res.Status)
+	}
+
+	// The server returns error statuses along with a JSON-RPC error object for
+	// RPC errors, such as a name not existing, which are passed on to the
+	// caller. Other error statuses, and RPC errors which indicate a problem
+	// with the server rather than with the request, are failures of the
+	// server.
+	if res.StatusCode != http.StatusOK {
+		var r struct {
+			Error *btcjson.Error `json:"error"`
+		}
+
+		err = json.Unmarshal(body, &r)
+		if err != nil || r.Error == nil {
+			return nil, fmt.Errorf("HTTP error: %s", res.Status)
+		}
+
+		if isServerError(r.Error.Code) {
+			return nil, fmt.Errorf("RPC server error %d: %s", r.Error.Code, r.Error.Message)
+		}
+	}
+
+	return body, nil
+}
+
+// Returns true if the given JSON-RPC error code indicates that the server is
+// unable to handle requests at the moment, such that they should be sent to
+// another server.
+func isServerError(code int) bool {
+	switch code {
+	case -28, // RPC_IN_WARMUP
+		-9,     // RPC_CLIENT_NOT_CONNECTED
+		-10,    // RPC_CLIENT_IN_INITIAL_DOWNLOAD
+		-32603: // RPC_INTERNAL_ERROR
+		return true
+	default:
+		return false
+	}
+}
+
+// Information about a name, as returned by name_show.
+type NameInfo struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	TxID    string `json:"txid"`
+	Address string `json:"address"`
+
+	// The height of the block containing the most recent update to the name.
+	Height int `json:"height"`
+
+	// The number of blocks remaining until the name expires. This is zero or
+	// negative if the name has expired.
+	ExpiresIn int  `json:"expires_in"`
+	Expired   bool `json:"expired"`
 }
 
 // Query the Namecoin daemon for a Namecoin domain (e.g. d/example).
-// If the domain exists, returns the value stored in Namecoin, which should be JSON.
-// Note that this will return domain data even if the domain is expired.
-func (nc *Conn) Query(name string) (v string, err error) {
+// If the domain exists, returns the value stored in Namecoin, which should be
+// JSON, along with information about the name.
+//
+// Note that this will return domain data even if the domain is expired. Check
+// the Expired field of the result.
+func (nc *Conn) Query(ctx context.Context, name string) (*NameInfo, error) {
 	cQueryCalls.Add(1)
 
 	cmd, err := extratypes.NewNameShowCmd(newID(), name)
 	if err != nil {
 		//log.Info("NC NEWCMD ", err)
-		return "", err
+		return nil, err
 	}
 
-	r, err := nc.rpcSend(cmd)
+	body, err := nc.rpcPost(ctx, cmd)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return parseNameShowReply(body)
+}
+
+// The reply to name_show is parsed here rather than by btcjson so that all
+// of the information returned about the name is available.
+func parseNameShowReply(body []byte) (*NameInfo, error) {
+	var r struct {
+		Result *struct {
+			NameInfo
+
+			// Used to determine whether expires_in was returned at all.
+			ExpiresIn *int `json:"expires_in"`
+		} `json:"result"`
+		Error *btcjson.Error `json:"error"`
+	}
+
+	err := json.Unmarshal(body, &r)
+	if err != nil {
+		//log.Info("NC BADREPLY")
+		return nil, fmt.Errorf("bad reply: %v", err)
 	}
 
 	if r.Error != nil {
 		//log.Info("RPC error: ", r.Error)
 		if r.Error.Code == -4 {
-			return "", merr.ErrNoSuchDomain
+			return nil, merr.ErrNoSuchDomain
 		}
-		return "", r.Error
+		return nil, r.Error
 	}
 
 	if r.Result == nil {
 		//log.Info("NC NILRESULT")
-		return "", fmt.Errorf("got nil result")
+		return nil, fmt.Errorf("got nil result")
 	}
 
-	if nsr, ok := r.Result.(*extratypes.NameShowReply); ok {
-		//log.Info("NC OK")
-		return nsr.Value, nil
+	// Older versions of namecoind do not return the expired flag, but it can
+	// be inferred from expires_in if that was returned.
+	info := &r.Result.NameInfo
+	if r.Result.ExpiresIn != nil {
+		info.ExpiresIn = *r.Result.ExpiresIn
+		if info.ExpiresIn <= 0 {
+			info.Expired = true
+		}
 	}
 
-	//log.Info("NC BADREPLY")
-	return "", fmt.Errorf("bad reply")
+	//log.Info("NC OK")
+	return info, nil
+}
+
+// The result of querying a single name using QueryMany.
+type QueryResult struct {
+	NameInfo
+	Err error
+}
+
+// Query the Namecoin daemon for several names at once using a single JSON-RPC
+// batch request. Returns a result for each name, in the same order as the
+// names given, each of which is as would be returned by Query. A non-nil
+// error is returned only if the batch request as a whole failed.
+func (nc *Conn) QueryMany(ctx context.Context, names []string) ([]QueryResult, error) {
+	cQueryManyCalls.Add(1)
+
+	results := make([]QueryResult, len(names))
+	if len(names) == 0 {
+		return results, nil
+	}
+
+	// Batches are a JSON-RPC 2.0 feature, so the requests in them must be
+	// JSON-RPC 2.0 requests.
+	reqs := make([]*rpcRequest, len(names))
+	idx := map[int32]int{}
+	for i, name := range names {
+		id := newID()
+		reqs[i] = &rpcRequest{
+			JSONRPC: "2.0",
+			ID:      id,
+			Method:  "name_show",
+			Params:  []interface{}{name},
+		}
+		idx[id] = i
+	}
+
+	body, err := nc.rpcPost(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []json.RawMessage
+	err = json.Unmarshal(body, &replies)
+	if err != nil {
+		// If the batch as a whole was rejected, a single error is returned.
+		var r struct {
+			Error *btcjson.Error `json:"error"`
+		}
+		if json.Unmarshal(body, &r) == nil && r.Error != nil {
+			return nil, r.Error
+		}
+
+		return nil, fmt.Errorf("bad batch reply: %v", err)
+	}
+
+	seen := make([]bool, len(names))
+	for _, reply := range replies {
+		var rid struct {
+			ID int32 `json:"id"`
+		}
+
+		err = json.Unmarshal(reply, &rid)
+		if err != nil {
+			return nil, fmt.Errorf("bad batch reply: %v", err)
+		}
+
+		i, ok := idx[rid.ID]
+		if !ok || seen[i] {
+			return nil, fmt.Errorf("bad batch reply: unexpected ID %d", rid.ID)
+		}
+
+		seen[i] = true
+
+		info, err := parseNameShowReply(reply)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		results[i].NameInfo = *info
+	}
+
+	for i := range seen {
+		if !seen[i] {
+			results[i].Err = fmt.Errorf("no reply in batch")
+		}
+	}
+
+	return results, nil
+}
+
+// Returns every value which the given name has had, oldest first, as returned
+// by name_history. This requires namecoind to be run with -namehistory.
+func (nc *Conn) History(ctx context.Context, name string) ([]NameInfo, error) {
+	cHistoryCalls.Add(1)
+
+	var history []NameInfo
+	err := nc.rpcCall(ctx, "name_history", []interface{}{name}, &history)
+	if err != nil {
+		if e, ok := err.(*btcjson.Error); ok && e.Code == -4 {
+			return nil, merr.ErrNoSuchDomain
+		}
+		return nil, err
+	}
+
+	return history, nil
 }
 
 var ErrSyncNoSuchBlock = fmt.Errorf("no block exists with given hash")
 
 const rpcInvalidAddressOrKey = -5
 
-func (nc *Conn) Sync(hash string, count int, wait bool) ([]extratypes.NameSyncEvent, error) {
+func (nc *Conn) Sync(ctx context.Context, hash string, count int, wait bool) ([]extratypes.NameSyncEvent, error) {
 	cSyncCalls.Add(1)
 
 	cmd, err := extratypes.NewNameSyncCmd(newID(), hash, count, wait)
@@ -105,7 +426,7 @@ func (nc *Conn) Sync(hash string, count int, wait bool) ([]extratypes.NameSyncEv
 		return nil, err
 	}
 
-	r, err := nc.rpcSend(cmd)
+	r, err := nc.rpcSend(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +449,7 @@ func (nc *Conn) Sync(hash string, count int, wait bool) ([]extratypes.NameSyncEv
 	return nil, fmt.Errorf("bad reply")
 }
 
-func (nc *Conn) CurHeight() (int, error) {
+func (nc *Conn) CurHeight(ctx context.Context) (int, error) {
 	cCurHeightCalls.Add(1)
 
 	cmd, err := btcjson.NewGetInfoCmd(newID())
@@ -136,7 +457,7 @@ func (nc *Conn) CurHeight() (int, error) {
 		return 0, err
 	}
 
-	r, err := nc.rpcSend(cmd)
+	r, err := nc.rpcSend(ctx, cmd)
 	if err != nil {
 		return 0, err
 	}
@@ -156,7 +477,78 @@ func (nc *Conn) CurHeight() (int, error) {
 	return 0, fmt.Errorf("bad reply")
 }
 
-func (nc *Conn) Filter(regexp string, maxage, from, count int) (names []extratypes.NameFilterItem, err error) {
+// Information about the state of the block chain, as returned by
+// getblockchaininfo.
+type ChainInfo struct {
+	Blocks               int    `json:"blocks"`
+	Headers              int    `json:"headers"`
+	BestBlockHash        string `json:"bestblockhash"`
+	InitialBlockDownload bool   `json:"initialblockdownload"`
+}
+
+func (nc *Conn) ChainInfo(ctx context.Context) (*ChainInfo, error) {
+	cChainInfoCalls.Add(1)
+
+	var info ChainInfo
+	err := nc.rpcCall(ctx, "getblockchaininfo", []interface{}{}, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// Information about a block, as returned by getblockheader.
+type BlockHeader struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+
+	// The block timestamp, in seconds since the Unix epoch.
+	Time int64 `json:"time"`
+}
+
+func (nc *Conn) BlockHeader(ctx context.Context, hash string) (*BlockHeader, error) {
+	cBlockHeaderCalls.Add(1)
+
+	var hdr BlockHeader
+	err := nc.rpcCall(ctx, "getblockheader", []interface{}{hash}, &hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hdr, nil
+}
+
+// Returns the hash of the block at the tip of the chain.
+func (nc *Conn) CurBlockHash(ctx context.Context) (string, error) {
+	cCurBlockHashCalls.Add(1)
+
+	cmd, err := btcjson.NewGetBestBlockHashCmd(newID())
+	if err != nil {
+		return "", err
+	}
+
+	r, err := nc.rpcSend(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	if r.Error != nil {
+		return "", r.Error
+	}
+
+	if r.Result == nil {
+		return "", fmt.Errorf("got nil result")
+	}
+
+	if hash, ok := r.Result.(string); ok {
+		return hash, nil
+	}
+
+	return "", fmt.Errorf("bad reply")
+}
+
+func (nc *Conn) Filter(ctx context.Context, regexp string, maxage, from, count int) (names []extratypes.NameFilterItem, err error) {
 	cFilterCalls.Add(1)
 
 	cmd, err := extratypes.NewNameFilterCmd(newID(), regexp, maxage, from, count)
@@ -164,7 +556,7 @@ func (nc *Conn) Filter(regexp string, maxage, from, count int) (names []extratyp
 		return nil, err
 	}
 
-	r, err := nc.rpcSend(cmd)
+	r, err := nc.rpcSend(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -184,7 +576,7 @@ func (nc *Conn) Filter(regexp string, maxage, from, count int) (names []extratyp
 	return nil, fmt.Errorf("bad reply")
 }
 
-func (nc *Conn) Scan(from string, count int) (names []extratypes.NameFilterItem, err error) {
+func (nc *Conn) Scan(ctx context.Context, from string, count int) (names []extratypes.NameFilterItem, err error) {
 	cScanCalls.Add(1)
 
 	cmd, err := extratypes.NewNameScanCmd(newID(), from, count)
@@ -192,7 +584,7 @@ func (nc *Conn) Scan(from string, count int) (names []extratypes.NameFilterItem,
 		return nil, err
 	}
 
-	r, err := nc.rpcSend(cmd)
+	r, err := nc.rpcSend(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
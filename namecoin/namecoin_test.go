@@ -0,0 +1,127 @@
+package namecoin
+
+import (
+	"context"
+	"encoding/json"
+	"gopkg.in/hlandau/madns.v1/merr"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var parseNameShowReplyTests = []struct {
+	body      string
+	expiresIn int
+	expired   bool
+}{
+	{`{"result": {"name": "d/example", "value": "{}", "expires_in": 100}, "error": null, "id": 1}`, 100, false},
+	{`{"result": {"name": "d/example", "value": "{}", "expires_in": 100, "expired": false}, "error": null, "id": 1}`, 100, false},
+	{`{"result": {"name": "d/example", "value": "{}", "expires_in": -5, "expired": true}, "error": null, "id": 1}`, -5, true},
+
+	// Older versions of namecoind don't return the expired flag.
+	{`{"result": {"name": "d/example", "value": "{}", "expires_in": 0}, "error": null, "id": 1}`, 0, true},
+
+	// Names are not assumed to have expired if expires_in isn't returned.
+	{`{"result": {"name": "d/example", "value": "{}"}, "error": null, "id": 1}`, 0, false},
+}
+
+func TestParseNameShowReply(t *testing.T) {
+	for i, tt := range parseNameShowReplyTests {
+		info, err := parseNameShowReply([]byte(tt.body))
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+
+		if info.Name != "d/example" || info.ExpiresIn != tt.expiresIn || info.Expired != tt.expired {
+			t.Errorf("%d: expected expires_in %d and expired %v, got %+v", i, tt.expiresIn, tt.expired, info)
+		}
+	}
+}
+
+// Answers batches of name_show requests in reverse order. d/missing does not
+// exist, d/broken fails, and no reply is given for d/ignored.
+func batchServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var reqs []struct {
+			JSONRPC string   `json:"jsonrpc"`
+			ID      int32    `json:"id"`
+			Method  string   `json:"method"`
+			Params  []string `json:"params"`
+		}
+
+		err := json.NewDecoder(req.Body).Decode(&reqs)
+		if err != nil {
+			t.Errorf("bad batch request: %v", err)
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var replies []interface{}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			r := reqs[i]
+			if r.JSONRPC != "2.0" || r.Method != "name_show" || len(r.Params) != 1 {
+				t.Errorf("bad request in batch: %+v", r)
+				continue
+			}
+
+			switch name := r.Params[0]; name {
+			case "d/missing":
+				replies = append(replies, map[string]interface{}{
+					"jsonrpc": "2.0",
+					"error":   map[string]interface{}{"code": -4, "message": "name not found"},
+					"id":      r.ID,
+				})
+			case "d/broken":
+				replies = append(replies, map[string]interface{}{
+					"jsonrpc": "2.0",
+					"error":   map[string]interface{}{"code": -1, "message": "something went wrong"},
+					"id":      r.ID,
+				})
+			case "d/ignored":
+			default:
+				replies = append(replies, map[string]interface{}{
+					"jsonrpc": "2.0",
+					"result":  map[string]interface{}{"name": name, "value": "value of " + name, "expires_in": 100},
+					"id":      r.ID,
+				})
+			}
+		}
+
+		json.NewEncoder(rw).Encode(replies)
+	}))
+}
+
+func TestQueryMany(t *testing.T) {
+	srv := batchServer(t)
+	defer srv.Close()
+
+	nc := Conn{Server: strings.TrimPrefix(srv.URL, "http://")}
+	names := []string{"d/a", "d/missing", "d/b", "d/broken", "d/ignored"}
+	results, err := nc.QueryMany(context.Background(), names)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(results) != len(names) {
+		t.Fatalf("expected %d results, got %d", len(names), len(results))
+	}
+
+	// Results are matched to names by ID, whatever order they are in.
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].Name != names[i] || results[i].Value != "value of "+names[i] {
+			t.Errorf("%s: unexpected result %+v", names[i], results[i])
+		}
+	}
+
+	if results[1].Err != merr.ErrNoSuchDomain {
+		t.Errorf("d/missing: expected ErrNoSuchDomain, got %v", results[1].Err)
+	}
+
+	for _, i := range []int{3, 4} {
+		if results[i].Err == nil || results[i].Err == merr.ErrNoSuchDomain {
+			t.Errorf("%s: expected error, got %+v", names[i], results[i])
+		}
+	}
+}
@@ -757,6 +757,74 @@ func parseImportImpl(rv map[string]interface{}, val *Value, resolve ResolveFunc,
 	return succeeded, err
 }
 
+// Returns the names referenced by "import" and "delegate" items in the given
+// JSON value, including those in subdomains. Names are in Namecoin form (e.g.
+// "d/example") and each is returned once. Only the value given is examined;
+// the values of the names returned may reference further names.
+//
+// This can be used to retrieve the values which ParseValue will require in
+// advance. Malformed values and items are ignored.
+func ReferencedNames(jsonValue string) []string {
+	var rv interface{}
+
+	err := json.Unmarshal([]byte(jsonValue), &rv)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	seen := map[string]struct{}{}
+	referencedNames(rv, 0, seen, &names)
+	return names
+}
+
+func referencedNames(rv interface{}, depth int, seen map[string]struct{}, names *[]string) {
+	rvm, ok := rv.(map[string]interface{})
+	if !ok || depth > depthLimit {
+		return
+	}
+
+	for _, xname := range []string{"delegate", "import"} {
+		src, ok := rvm[xname]
+		if !ok || src == nil {
+			continue
+		}
+
+		if s, ok := src.(string); ok {
+			src = []interface{}{s}
+		}
+
+		a, ok := src.([]interface{})
+		if !ok {
+			continue
+		}
+
+		if isAllString(a) {
+			a = []interface{}{a}
+		}
+
+		for _, vx := range a {
+			v, ok := vx.([]interface{})
+			if !ok || len(v) < 1 {
+				continue
+			}
+
+			if k, ok := v[0].(string); ok {
+				if _, ok := seen[k]; !ok {
+					seen[k] = struct{}{}
+					*names = append(*names, k)
+				}
+			}
+		}
+	}
+
+	if m, ok := rvm["map"].(map[string]interface{}); ok {
+		for _, mv := range m {
+			referencedNames(mv, depth+1, seen, names)
+		}
+	}
+}
+
 func parseImport(rv map[string]interface{}, v *Value, resolve ResolveFunc, errFunc ErrorFunc, depth, mergeDepth int, relname string, mergedNames map[string]struct{}) error {
 	_, err := parseImportImpl(rv, v, resolve, errFunc, depth, mergeDepth, relname, mergedNames, false)
 	return err
@@ -62,6 +62,30 @@ func TestSuite(t *testing.T) {
 	}
 }
 
+func TestReferencedNames(t *testing.T) {
+	items := []struct {
+		jsonValue string
+		names     string
+	}{
+		{`{}`, ``},
+		{`{"ip":"1.2.3.4"}`, ``},
+		{`{"import":"d/a"}`, `d/a`},
+		{`{"import":["d/a","sub"]}`, `d/a`},
+		{`{"import":[["d/a"],["d/b","sub"]],"delegate":"d/a"}`, `d/a d/b`},
+		{`{"map":{"www":{"import":"d/c"},"x":{"map":{"y":{"delegate":["d/d"]}}}}}`, `d/c d/d`},
+		{`{"import":42}`, ``},
+		{`not json`, ``},
+	}
+
+	for _, item := range items {
+		names := ncdomain.ReferencedNames(item.jsonValue)
+		sort.Strings(names)
+		if s := strings.Join(names, " "); s != item.names {
+			t.Errorf("Didn't match for %s: %#v != %#v", item.jsonValue, s, item.names)
+		}
+	}
+}
+
 func convertName(n string) (string, error) {
 	if len(n) < 3 || len(n) > 65 {
 		return "", fmt.Errorf("invalid name")
@@ -7,6 +7,7 @@ import "fmt"
 import "os"
 import "strconv"
 import "io/ioutil"
+import "context"
 import "github.com/namecoin/ncdns/util"
 
 var rpchost = flag.String("rpchost", "", "Namecoin RPC host:port")
@@ -41,7 +42,12 @@ func translateValue(k, v string) (string, error) {
 
 		f = os.NewFile(uintptr(n), "-")
 	} else if len(v) == 1 {
-		return conn.Query(k)
+		info, err := conn.Query(context.Background(), k)
+		if err != nil {
+			return "", err
+		}
+
+		return info.Value, nil
 	} else {
 		f, err = os.Open(v)
 	}
@@ -1,12 +1,14 @@
 package main
 
 import "gopkg.in/alecthomas/kingpin.v2"
+import extratypes "github.com/hlandau/ncbtcjsontypes"
 import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/util"
 import "github.com/hlandau/xlog"
 import "strings"
 import "fmt"
+import "context"
 
 var log, Log = xlog.New("ncdumpzone")
 
@@ -32,15 +34,38 @@ func main() {
 		errors = append(errors, err)
 	}
 
+	// Values of names referenced by the current page of results, retrieved
+	// using a batch request.
+	var prefetched map[string]namecoin.QueryResult
+
+	// Expired names are treated as nonexistent, as they are by ncdns.
 	getNameFunc := func(k string) (string, error) {
-		return conn.Query(k)
+		info, ok := prefetched[k]
+		if !ok {
+			ni, err := conn.Query(context.Background(), k)
+			if err != nil {
+				return "", err
+			}
+
+			info = namecoin.QueryResult{NameInfo: *ni}
+		}
+
+		if info.Err != nil {
+			return "", info.Err
+		}
+
+		if info.Expired {
+			return "", fmt.Errorf("name has expired: %s", k)
+		}
+
+		return info.Value, nil
 	}
 
 	currentName := "d/"
 	continuing := 0
 
 	for {
-		results, err := conn.Scan(currentName, perCall)
+		results, err := conn.Scan(context.Background(), currentName, perCall)
 		log.Fatale(err, "scan")
 
 		if len(results) <= continuing {
@@ -55,6 +80,8 @@ func main() {
 			continuing = 1
 		}
 
+		prefetched = prefetchNames(results)
+
 		for i := range results {
 			r := &results[i]
 
@@ -64,6 +91,11 @@ func main() {
 				continue
 			}
 
+			// Expired names are not served by ncdns, so they are omitted.
+			if r.ExpiresIn <= 0 {
+				continue
+			}
+
 			suffix, err := util.NamecoinKeyToBasename(r.Name)
 			if err != nil {
 				continue
@@ -86,3 +118,39 @@ func main() {
 		currentName = results[len(results)-1].Name
 	}
 }
+
+// Retrieves the values of all names referenced via "import" or "delegate" by
+// the domain names in the given results using a single batch request.
+func prefetchNames(results []extratypes.NameFilterItem) map[string]namecoin.QueryResult {
+	var names []string
+	seen := map[string]struct{}{}
+	for i := range results {
+		if !strings.HasPrefix(results[i].Name, "d/") {
+			continue
+		}
+
+		for _, name := range ncdomain.ReferencedNames(results[i].Value) {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+
+	prefetched := map[string]namecoin.QueryResult{}
+	if len(names) == 0 {
+		return prefetched
+	}
+
+	values, err := conn.QueryMany(context.Background(), names)
+	if err != nil {
+		log.Warne(err, "batch query failed")
+		return prefetched
+	}
+
+	for i, name := range names {
+		prefetched[name] = values[i]
+	}
+
+	return prefetched
+}
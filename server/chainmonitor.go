@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"sync"
+	"time"
+)
+
+// Periodically checks whether namecoind is synced with the network, and
+// informs the backend accordingly. namecoind is considered synced if it is
+// not in initial block download and the block at the tip of its chain is no
+// older than maxTipAge.
+type chainMonitor struct {
+	conn      namecoin.Conn
+	b         *backend.Backend
+	timeout   time.Duration
+	interval  time.Duration
+	maxTipAge time.Duration
+
+	mutex sync.Mutex
+	state chainState
+}
+
+// The most recently observed state of namecoind.
+type chainState struct {
+	// False until namecoind has been checked successfully.
+	Checked bool
+
+	Synced               bool
+	Height               int
+	Headers              int
+	InitialBlockDownload bool
+	TipTime              time.Time
+
+	// The error encountered during the most recent check, if any.
+	Err error
+}
+
+func newChainMonitor(conn namecoin.Conn, b *backend.Backend, timeout, interval, maxTipAge time.Duration) *chainMonitor {
+	return &chainMonitor{
+		conn:      conn,
+		b:         b,
+		timeout:   timeout,
+		interval:  interval,
+		maxTipAge: maxTipAge,
+	}
+}
+
+// Checks the state of namecoind at the configured interval. Does not return.
+func (cm *chainMonitor) Run() {
+	for {
+		cm.check()
+		time.Sleep(cm.interval)
+	}
+}
+
+func (cm *chainMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), cm.timeout)
+	defer cancel()
+
+	ci, err := cm.conn.ChainInfo(ctx)
+	if err != nil {
+		cm.setError(err)
+		return
+	}
+
+	hdr, err := cm.conn.BlockHeader(ctx, ci.BestBlockHash)
+	if err != nil {
+		cm.setError(err)
+		return
+	}
+
+	tipTime := time.Unix(hdr.Time, 0)
+	tipAge := time.Since(tipTime)
+	synced := !ci.InitialBlockDownload && tipAge <= cm.maxTipAge
+
+	cm.mutex.Lock()
+	wasSynced := !cm.state.Checked || cm.state.Synced
+	cm.state = chainState{
+		Checked:              true,
+		Synced:               synced,
+		Height:               ci.Blocks,
+		Headers:              ci.Headers,
+		InitialBlockDownload: ci.InitialBlockDownload,
+		TipTime:              tipTime,
+	}
+	cm.mutex.Unlock()
+
+	cm.b.SetSynced(synced)
+	cm.b.SetBlockHeight(ci.Blocks)
+
+	// Keep complaining for as long as namecoind is not synced, as the names
+	// being served may be out of date.
+	if !synced {
+		log.Warnf("namecoind is not synced: at height %d of %d, tip is %v old, initial block download: %v",
+			ci.Blocks, ci.Headers, tipAge/time.Second*time.Second, ci.InitialBlockDownload)
+	} else if !wasSynced {
+		log.Infof("namecoind is synced again at height %d", ci.Blocks)
+	}
+}
+
+// If namecoind can't be queried, its sync state is unknown, so the previous
+// state is retained; lookups will fail anyway.
+func (cm *chainMonitor) setError(err error) {
+	log.Warne(err, "failed to check namecoind sync state")
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	cm.state.Err = err
+}
+
+// Returns the most recently observed state of namecoind.
+func (cm *chainMonitor) State() chainState {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	return cm.state
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"net"
+	"strings"
+)
+
+// Maximum number of CNAMEs which will be followed when answering a query.
+const maxCNAMEChain = 8
+
+// Follows in-zone CNAME chains and adds the addresses of in-zone MX, SRV and
+// NS targets to the additional section, so that clients don't need to make
+// further queries for .bit names, which may go via resolvers which don't know
+// about .bit. The records added are obtained by querying the next handler, so
+// they are resolved through the backend's cache and signed as usual, except
+// for glue for nameservers within the domains delegated to them, which is
+// obtained from the backend directly.
+type chaseHandler struct {
+	next  dns.Handler
+	b     *backend.Backend
+	zones []string
+}
+
+func (h *chaseHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || !inBitZone(req.Question[0].Name, h.zones) {
+		h.next.ServeDNS(rw, req)
+		return
+	}
+
+	r := h.query(rw, req, req.Question[0].Name, req.Question[0].Qtype)
+	if r == nil {
+		return
+	}
+
+	r.Id = req.Id
+	if r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError {
+		full := r.Copy()
+		h.chaseCNAMEs(rw, req, full)
+		h.addGlue(rw, req, full)
+		if full.Len() <= maxResponseSize(rw, req) {
+			r = full
+		}
+	}
+
+	rw.WriteMsg(r)
+}
+
+// Passes a query for the given name and type, with the same flags as req, to
+// the next handler and returns the response.
+func (h *chaseHandler) query(rw dns.ResponseWriter, req *dns.Msg, name string, qtype uint16) *dns.Msg {
+	q := req.Copy()
+	q.Question = []dns.Question{{Name: name, Qtype: qtype, Qclass: req.Question[0].Qclass}}
+
+	crw := &dohResponseWriter{remoteAddr: rw.RemoteAddr()}
+	h.next.ServeDNS(crw, q)
+	return crw.msg
+}
+
+// If the answer ends with a CNAME to another name in the zone, appends the
+// answer for that name, repeating until the chain ends, leaves the zone,
+// loops or becomes too long.
+func (h *chaseHandler) chaseCNAMEs(rw dns.ResponseWriter, req *dns.Msg, r *dns.Msg) {
+	qtype := req.Question[0].Qtype
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return
+	}
+
+	seen := map[string]struct{}{
+		strings.ToLower(req.Question[0].Name): struct{}{},
+	}
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		target := cnameTarget(r.Answer, seen)
+		if target == "" || !inBitZone(target, h.zones) {
+			return
+		}
+
+		if _, ok := seen[strings.ToLower(target)]; ok {
+			log.Infof("CNAME loop at %s", target)
+			return
+		}
+		seen[strings.ToLower(target)] = struct{}{}
+
+		tr := h.query(rw, req, target, qtype)
+		if tr == nil || (tr.Rcode != dns.RcodeSuccess && tr.Rcode != dns.RcodeNameError) {
+			return
+		}
+
+		r.Answer = append(r.Answer, tr.Answer...)
+		r.Ns = tr.Ns
+		r.Rcode = tr.Rcode
+	}
+}
+
+// Returns the target of the last CNAME in the answer, provided that its owner
+// is the end of the chain so far.
+func cnameTarget(answer []dns.RR, seen map[string]struct{}) string {
+	for i := len(answer) - 1; i >= 0; i-- {
+		if cname, ok := answer[i].(*dns.CNAME); ok {
+			if _, ok := seen[strings.ToLower(cname.Hdr.Name)]; !ok {
+				return ""
+			}
+			return cname.Target
+		}
+	}
+
+	return ""
+}
+
+// Adds the A and AAAA records of in-zone targets of MX, SRV and NS records in
+// the response to the additional section.
+func (h *chaseHandler) addGlue(rw dns.ResponseWriter, req *dns.Msg, r *dns.Msg) {
+	var targets []string
+
+	// Nameservers within the domains delegated to them. Queries for these
+	// would only yield referrals.
+	inBailiwick := map[string]struct{}{}
+
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			switch v := rr.(type) {
+			case *dns.MX:
+				targets = append(targets, v.Mx)
+			case *dns.SRV:
+				targets = append(targets, v.Target)
+			case *dns.NS:
+				targets = append(targets, v.Ns)
+				if !strings.EqualFold(v.Hdr.Name, xfrZone) && dns.IsSubDomain(v.Hdr.Name, v.Ns) {
+					inBailiwick[strings.ToLower(v.Ns)] = struct{}{}
+				}
+			}
+		}
+	}
+
+	have := map[string]struct{}{}
+	for _, rr := range r.Extra {
+		hdr := rr.Header()
+		have[strings.ToLower(hdr.Name)+"/"+dns.TypeToString[hdr.Rrtype]] = struct{}{}
+	}
+
+	done := map[string]struct{}{}
+	for _, t := range targets {
+		lt := strings.ToLower(t)
+		if _, ok := done[lt]; ok || t == "." || !inBitZone(t, h.zones) {
+			continue
+		}
+		done[lt] = struct{}{}
+
+		if _, ok := inBailiwick[lt]; ok {
+			glue, err := h.b.Glue(t)
+			if err == nil {
+				for _, rr := range glue {
+					if _, ok := have[lt+"/"+dns.TypeToString[rr.Header().Rrtype]]; !ok {
+						r.Extra = append(r.Extra, rr)
+					}
+				}
+				continue
+			}
+		}
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if _, ok := have[lt+"/"+dns.TypeToString[qtype]]; ok {
+				continue
+			}
+
+			tr := h.query(rw, req, t, qtype)
+			if tr == nil || tr.Rcode != dns.RcodeSuccess {
+				continue
+			}
+
+			for _, rr := range tr.Answer {
+				if strings.EqualFold(rr.Header().Name, t) {
+					r.Extra = append(r.Extra, rr)
+				}
+			}
+		}
+	}
+}
+
+// Returns the maximum size of a response which can be sent to the client
+// without truncation.
+func maxResponseSize(rw dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := rw.RemoteAddr().(*net.UDPAddr); !ok {
+		return dns.MaxMsgSize
+	}
+
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+
+	return dns.MinMsgSize
+}
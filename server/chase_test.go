@@ -0,0 +1,246 @@
+package server
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"gopkg.in/hlandau/madns.v1/merr"
+	"net"
+	"strings"
+	"testing"
+)
+
+const chaseValue = `{
+  "ip": "192.0.2.1",
+  "mx": [[10, "mail.example.bit."]],
+  "map": {
+    "www": { "alias": "host.example.bit." },
+    "host": { "alias": "final.example.bit." },
+    "final": { "ip": "192.0.2.2" },
+    "mail": { "ip": "192.0.2.25" },
+    "loop1": { "alias": "loop2.example.bit." },
+    "loop2": { "alias": "loop1.example.bit." },
+    "out": { "alias": "example.com." },
+    "c0": { "alias": "c1.example.bit." },
+    "c1": { "alias": "c2.example.bit." },
+    "c2": { "alias": "c3.example.bit." },
+    "c3": { "alias": "c4.example.bit." },
+    "c4": { "alias": "c5.example.bit." },
+    "c5": { "alias": "c6.example.bit." },
+    "c6": { "alias": "c7.example.bit." },
+    "c7": { "alias": "c8.example.bit." },
+    "c8": { "alias": "c9.example.bit." },
+    "c9": { "alias": "c10.example.bit." },
+    "c10": { "ip": "192.0.2.10" },
+    "sub": {
+      "ns": ["ns1.sub.example.bit."],
+      "map": { "ns1": { "ip": "192.0.2.53" } }
+    }
+  }
+}`
+
+// A minimal stand-in for the engine which answers queries directly from the
+// backend, placing records owned by names other than the query name, such as
+// those of delegations, in the authority section.
+type backendHandler struct {
+	b *backend.Backend
+}
+
+func (h *backendHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	r := &dns.Msg{}
+	r.SetReply(req)
+
+	rrs, err := h.b.Lookup(q.Name)
+	switch {
+	case err == merr.ErrNoSuchDomain:
+		r.Rcode = dns.RcodeNameError
+	case err != nil:
+		r.Rcode = dns.RcodeServerFailure
+	}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		switch {
+		case !strings.EqualFold(hdr.Name, q.Name):
+			if hdr.Rrtype == dns.TypeNS {
+				r.Ns = append(r.Ns, rr)
+			}
+		case hdr.Rrtype == q.Qtype || hdr.Rrtype == dns.TypeCNAME:
+			r.Answer = append(r.Answer, rr)
+		}
+	}
+
+	rw.WriteMsg(r)
+}
+
+var chaseTests = []struct {
+	qname  string
+	qtype  uint16
+	answer []string // the owner and data of each record, e.g. "a.bit. 192.0.2.1"
+	extra  []string
+}{
+	// CNAME chains within the zone are followed.
+	{"www.example.bit.", dns.TypeA, []string{
+		"www.example.bit. host.example.bit.",
+		"host.example.bit. final.example.bit.",
+		"final.example.bit. 192.0.2.2",
+	}, nil},
+
+	// But not when CNAMEs are being asked for.
+	{"www.example.bit.", dns.TypeCNAME, []string{
+		"www.example.bit. host.example.bit.",
+	}, nil},
+
+	// Loops are detected, and chains leaving the zone are not followed.
+	{"loop1.example.bit.", dns.TypeA, []string{
+		"loop1.example.bit. loop2.example.bit.",
+		"loop2.example.bit. loop1.example.bit.",
+	}, nil},
+	{"out.example.bit.", dns.TypeA, []string{
+		"out.example.bit. example.com.",
+	}, nil},
+
+	// Long chains are followed only so far.
+	{"c0.example.bit.", dns.TypeA, cnameChain(maxCNAMEChain + 1), nil},
+
+	// The addresses of MX targets are added.
+	{"example.bit.", dns.TypeMX, []string{
+		"example.bit. 10 mail.example.bit.",
+	}, []string{
+		"mail.example.bit. 192.0.2.25",
+	}},
+
+	// Glue is added for nameservers within the domains delegated to them,
+	// taken from the addresses hidden by the delegation.
+	{"sub.example.bit.", dns.TypeNS, []string{
+		"sub.example.bit. ns1.sub.example.bit.",
+	}, []string{
+		"ns1.sub.example.bit. 192.0.2.53",
+	}},
+}
+
+// Returns the first n records of the chain of CNAMEs starting at
+// c0.example.bit.
+func cnameChain(n int) (answer []string) {
+	for i := 0; i < n; i++ {
+		answer = append(answer, fmt.Sprintf("c%d.example.bit. c%d.example.bit.", i, i+1))
+	}
+
+	return
+}
+
+// Returns the owner and data of a record, omitting the TTL, class and type.
+func ownerAndData(rr dns.RR) string {
+	hdr := rr.Header().String()
+	return rr.Header().Name + " " + strings.TrimPrefix(rr.String(), hdr)
+}
+
+func TestChase(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		FakeNames: map[string]string{
+			"d/example": chaseValue,
+		},
+	})
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+
+	h := &chaseHandler{
+		next:  &backendHandler{b: b},
+		b:     b,
+		zones: bitZones("bit"),
+	}
+
+	for _, tt := range chaseTests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.qname, tt.qtype)
+
+		rw := &recordingResponseWriter{dohResponseWriter: dohResponseWriter{remoteAddr: &net.TCPAddr{}}}
+		h.ServeDNS(rw, req)
+		if len(rw.msgs) != 1 {
+			t.Errorf("%s: expected one response, got %d", tt.qname, len(rw.msgs))
+			continue
+		}
+
+		r := rw.msgs[0]
+		for _, section := range []struct {
+			name     string
+			rrs      []dns.RR
+			expected []string
+		}{
+			{"answer", r.Answer, tt.answer},
+			{"additional", r.Extra, tt.extra},
+		} {
+			var got []string
+			for _, rr := range section.rrs {
+				got = append(got, ownerAndData(rr))
+			}
+
+			if strings.Join(got, "; ") != strings.Join(section.expected, "; ") {
+				t.Errorf("%s %s: expected %s section %v, got %v", tt.qname, dns.TypeToString[tt.qtype], section.name, section.expected, got)
+			}
+		}
+	}
+}
+
+func TestCNAMETarget(t *testing.T) {
+	a := mustRR(t, "a.example.bit. 600 IN CNAME b.example.bit.")
+	b := mustRR(t, "b.example.bit. 600 IN CNAME c.example.bit.")
+	x := mustRR(t, "x.example.bit. 600 IN CNAME y.example.bit.")
+	addr := mustRR(t, "c.example.bit. 600 IN A 192.0.2.1")
+
+	seen := map[string]struct{}{"a.example.bit.": {}, "b.example.bit.": {}}
+
+	tests := []struct {
+		answer []dns.RR
+		target string
+	}{
+		{nil, ""},
+		{[]dns.RR{addr}, ""},
+		{[]dns.RR{a}, "b.example.bit."},
+		{[]dns.RR{a, b}, "c.example.bit."},
+		{[]dns.RR{a, b, addr}, "c.example.bit."},
+
+		// The last CNAME must continue the chain.
+		{[]dns.RR{a, x}, ""},
+	}
+
+	for i, tt := range tests {
+		if target := cnameTarget(tt.answer, seen); target != tt.target {
+			t.Errorf("%d: expected %q, got %q", i, tt.target, target)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	udp := &dohResponseWriter{remoteAddr: &net.UDPAddr{}}
+	tcp := &dohResponseWriter{remoteAddr: &net.TCPAddr{}}
+
+	plain := &dns.Msg{}
+	plain.SetQuestion("example.bit.", dns.TypeA)
+
+	edns := plain.Copy()
+	edns.SetEdns0(4096, false)
+
+	small := plain.Copy()
+	small.SetEdns0(256, false)
+
+	tests := []struct {
+		rw   dns.ResponseWriter
+		req  *dns.Msg
+		size int
+	}{
+		{udp, plain, dns.MinMsgSize},
+		{udp, edns, 4096},
+		{udp, small, dns.MinMsgSize},
+		{tcp, plain, dns.MaxMsgSize},
+		{tcp, edns, dns.MaxMsgSize},
+	}
+
+	for i, tt := range tests {
+		if size := maxResponseSize(tt.rw, tt.req); size != tt.size {
+			t.Errorf("%d: expected %d, got %d", i, tt.size, size)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const dohContentType = "application/dns-message"
+
+// Maximum size of a DNS message.
+const dohMaxMessageSize = 65535
+
+// Serves DNS-over-HTTPS (RFC 8484) requests at /dns-query.
+func (ws *webServer) handleDNSQuery(rw http.ResponseWriter, req *http.Request) {
+	var msg []byte
+	var err error
+
+	switch req.Method {
+	case "GET":
+		msg, err = base64.RawURLEncoding.DecodeString(req.FormValue("dns"))
+		if err != nil || len(msg) == 0 {
+			http.Error(rw, "missing or malformed dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case "POST":
+		if req.Header.Get("Content-Type") != dohContentType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		msg, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, dohMaxMessageSize))
+		if err != nil {
+			http.Error(rw, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := &dns.Msg{}
+	err = q.Unpack(msg)
+	if err != nil {
+		http.Error(rw, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	r := ws.serveDNS(req, q)
+	if r == nil {
+		http.Error(rw, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := r.Pack()
+	if err != nil {
+		log.Errore(err, "failed to pack DNS-over-HTTPS response")
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohContentType)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(r)))
+	rw.Write(res)
+}
+
+// Serves JSON DNS queries at /resolve, in the form used by several public
+// DNS-over-HTTPS services, e.g. /resolve?name=example.bit&type=AAAA.
+func (ws *webServer) handleResolve(rw http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	if name == "" {
+		http.Error(rw, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := req.FormValue("type"); t != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			n, err := strconv.ParseUint(t, 10, 16)
+			if err != nil {
+				http.Error(rw, "unknown type", http.StatusBadRequest)
+				return
+			}
+			qtype = uint16(n)
+		}
+	}
+
+	q := &dns.Msg{}
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	if req.FormValue("do") == "1" || req.FormValue("do") == "true" {
+		q.SetEdns0(4096, true)
+	}
+	if req.FormValue("cd") == "1" || req.FormValue("cd") == "true" {
+		q.CheckingDisabled = true
+	}
+
+	r := ws.serveDNS(req, q)
+	if r == nil {
+		http.Error(rw, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	res := jsonResponse{
+		Status: r.Rcode,
+		TC:     r.Truncated,
+		RD:     r.RecursionDesired,
+		RA:     r.RecursionAvailable,
+		AD:     r.AuthenticatedData,
+		CD:     r.CheckingDisabled,
+	}
+
+	for _, qq := range r.Question {
+		res.Question = append(res.Question, jsonQuestion{Name: qq.Name, Type: qq.Qtype})
+	}
+
+	res.Answer = jsonRRs(r.Answer)
+	res.Authority = jsonRRs(r.Ns)
+
+	rw.Header().Set("Content-Type", "application/dns-json")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(r)))
+	err := json.NewEncoder(rw).Encode(&res)
+	log.Infoe(err, "failed to write JSON DNS response")
+}
+
+type jsonResponse struct {
+	Status    int
+	TC        bool
+	RD        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Question  []jsonQuestion
+	Answer    []jsonRR `json:",omitempty"`
+	Authority []jsonRR `json:",omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+func jsonRRs(rrs []dns.RR) (out []jsonRR) {
+	for _, rr := range rrs {
+		h := rr.Header()
+		out = append(out, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+
+	return
+}
+
+// Passes a DNS query to the DNS server's handler and returns the response.
+// Zone transfers are not supported.
+func (ws *webServer) serveDNS(req *http.Request, q *dns.Msg) *dns.Msg {
+	for _, qq := range q.Question {
+		if qq.Qtype == dns.TypeAXFR || qq.Qtype == dns.TypeIXFR {
+			r := &dns.Msg{}
+			r.SetRcode(q, dns.RcodeRefused)
+			return r
+		}
+	}
+
+	drw := &dohResponseWriter{}
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		p, _ := strconv.Atoi(port)
+		drw.remoteAddr = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	} else {
+		drw.remoteAddr = &net.TCPAddr{}
+	}
+
+	ws.s.mux.ServeDNS(drw, q)
+	return drw.msg
+}
+
+// Returns the lowest TTL of the records in a response, for use as the
+// lifetime of the HTTP response.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl
+}
+
+// A dns.ResponseWriter which captures the response to a single query.
+type dohResponseWriter struct {
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := &dns.Msg{}
+	err := m.Unpack(b)
+	if err != nil {
+		return 0, err
+	}
+
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (w *dohResponseWriter) Hijack() {
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+)
+
+// EDNS option code for Extended DNS Errors (RFC 8914).
+const ednsOptionEDE = 15
+
+// Adds an Extended DNS Error to responses to queries for .bit names whose
+// lookups failed or were answered with stale data, explaining why. Clients
+// must indicate that they support EDNS.
+//
+// The engine doesn't pass the outcome of its lookups back, so it is
+// determined after the engine has answered. Failed lookups are repeated,
+// which is usually answered from the cache or shares any request to namecoind
+// still in progress; successful answers are only checked against the cache
+// for staleness. Either may disagree with the answer if the cached value
+// changed in between.
+type edeHandler struct {
+	next  dns.Handler
+	b     *backend.Backend
+	zones []string
+}
+
+func (h *edeHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || req.IsEdns0() == nil || !inBitZone(req.Question[0].Name, h.zones) {
+		h.next.ServeDNS(rw, req)
+		return
+	}
+
+	crw := &dohResponseWriter{remoteAddr: rw.RemoteAddr()}
+	h.next.ServeDNS(crw, req)
+
+	r := crw.msg
+	if r == nil {
+		return
+	}
+
+	var ee *backend.ExtendedError
+	if r.Rcode == dns.RcodeSuccess {
+		ee = h.b.StaleError(req.Question[0].Name)
+	} else {
+		_, ee, _ = h.b.LookupExtended(req.Question[0].Name)
+	}
+
+	// Omit the error rather than truncating the response to make room for
+	// it.
+	if ee != nil {
+		full := r.Copy()
+		addExtendedError(full, req, ee)
+		if full.Len() <= maxResponseSize(rw, req) {
+			r = full
+		}
+	}
+
+	rw.WriteMsg(r)
+}
+
+func addExtendedError(r, req *dns.Msg, ee *backend.ExtendedError) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		reqOpt := req.IsEdns0()
+		r.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+		opt = r.IsEdns0()
+	}
+
+	data := make([]byte, 2+len(ee.ExtraText))
+	binary.BigEndian.PutUint16(data, ee.InfoCode)
+	copy(data[2:], ee.ExtraText)
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: ednsOptionEDE,
+		Data: data,
+	})
+}
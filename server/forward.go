@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/golang/groupcache/lru"
+	"github.com/miekg/dns"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time to wait for a response from each upstream resolver.
+const forwardTimeout = 2 * time.Second
+
+// Maximum time for which a forwarded response is cached, regardless of its
+// TTLs.
+const forwardCacheMaxAge = 1 * time.Hour
+
+// Time for which a forwarded response with no records (and so no TTLs) is
+// cached.
+const forwardNegativeCacheAge = 1 * time.Minute
+
+// Relays queries for names outside the .bit zone to upstream resolvers, so
+// that ncdns can be used as a machine's only resolver. All other queries are
+// passed on to the next handler.
+//
+// Queries received via DNS-over-HTTPS are never forwarded. The HTTP server is
+// expected to sit behind a TLS reverse proxy, so their remote addresses are
+// those of the proxy and can't be checked against the allowed networks.
+type forwardHandler struct {
+	next      dns.Handler
+	zones     []string
+	upstreams []*upstream
+
+	// Networks from which queries may be forwarded.
+	allow []*net.IPNet
+
+	cacheMutex sync.Mutex
+	cache      lru.Cache // items are of type *forwardCacheEntry
+}
+
+type upstream struct {
+	addr   string
+	client *dns.Client
+
+	// If set, this is used instead of client for queries received over TCP.
+	tcpClient *dns.Client
+}
+
+type forwardCacheEntry struct {
+	msg    *dns.Msg
+	added  time.Time
+	expire time.Time
+}
+
+func newForwardHandler(next dns.Handler, zones []string, upstreams []*upstream, allow []*net.IPNet, cacheMaxEntries int) *forwardHandler {
+	h := &forwardHandler{
+		next:      next,
+		zones:     zones,
+		upstreams: upstreams,
+		allow:     allow,
+	}
+	h.cache.MaxEntries = cacheMaxEntries
+	return h
+}
+
+func (h *forwardHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || inBitZone(req.Question[0].Name, h.zones) || !h.permitted(rw) {
+		h.next.ServeDNS(rw, req)
+		return
+	}
+
+	r, err := h.forward(rw, req)
+	if err != nil {
+		log.Infoe(err, "failed to forward query for ", req.Question[0].Name)
+		r = &dns.Msg{}
+		r.SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	// The response may have been obtained over TCP, either because the
+	// upstream is queried that way or because it was cached from a query
+	// received over TCP.
+	rw.WriteMsg(truncate(r, maxResponseSize(rw, req)))
+}
+
+// If the response is larger than the given size, returns a copy of it with
+// the TC bit set and its records removed, so that the client retries over
+// TCP. Otherwise returns the response as it is.
+func truncate(r *dns.Msg, size int) *dns.Msg {
+	if r.Len() <= size {
+		return r
+	}
+
+	t := r.Copy()
+	t.Truncated = true
+	t.Answer = nil
+	t.Ns = nil
+	t.Extra = nil
+	if opt := r.IsEdns0(); opt != nil {
+		t.Extra = []dns.RR{opt}
+	}
+
+	return t
+}
+
+// Returns the zones for which ncdns is authoritative: bit., and the canonical
+// suffix if it is of the form bit.example.org.
+func bitZones(canonicalSuffix string) []string {
+	zones := []string{"bit."}
+
+	suffix := dns.Fqdn(strings.ToLower(strings.Trim(canonicalSuffix, ".")))
+	if suffix != "bit." && strings.HasPrefix(suffix, "bit.") {
+		zones = append(zones, suffix)
+	}
+
+	return zones
+}
+
+// Returns true if the given name is within one of the given zones.
+func inBitZone(name string, zones []string) bool {
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, dns.Fqdn(name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *forwardHandler) permitted(rw dns.ResponseWriter) bool {
+	if _, ok := rw.(*dohResponseWriter); ok {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(rw.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	for _, n := range h.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *forwardHandler) forward(rw dns.ResponseWriter, req *dns.Msg) (*dns.Msg, error) {
+	key := forwardCacheKey(req)
+	if r := h.getCached(key, req); r != nil {
+		return r, nil
+	}
+
+	_, tcp := rw.RemoteAddr().(*net.TCPAddr)
+
+	var err error
+	for _, u := range h.upstreams {
+		client := u.client
+		if tcp && u.tcpClient != nil {
+			client = u.tcpClient
+		}
+
+		var r *dns.Msg
+		r, _, err = client.Exchange(req, u.addr)
+		if err != nil {
+			continue
+		}
+
+		if r.Rcode == dns.RcodeServerFailure {
+			err = fmt.Errorf("upstream %s returned SERVFAIL", u.addr)
+			continue
+		}
+
+		if !r.Truncated {
+			h.addCached(key, r)
+		}
+
+		return r, nil
+	}
+
+	return nil, err
+}
+
+func forwardCacheKey(req *dns.Msg) string {
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	return fmt.Sprintf("%s/%d/%d/%v/%v", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, req.CheckingDisabled)
+}
+
+// Returns a cached response to the given request, with its TTLs reduced by
+// the time for which it has been cached, or nil if there is none.
+func (h *forwardHandler) getCached(key string, req *dns.Msg) *dns.Msg {
+	h.cacheMutex.Lock()
+	defer h.cacheMutex.Unlock()
+
+	ee, ok := h.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	e := ee.(*forwardCacheEntry)
+	now := time.Now()
+	if !now.Before(e.expire) {
+		h.cache.Remove(key)
+		return nil
+	}
+
+	r := e.msg.Copy()
+	r.Id = req.Id
+
+	elapsed := uint32(now.Sub(e.added) / time.Second)
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				if hdr.Ttl > elapsed {
+					hdr.Ttl -= elapsed
+				} else {
+					hdr.Ttl = 0
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+func (h *forwardHandler) addCached(key string, r *dns.Msg) {
+	maxAge := forwardCacheMaxAge
+	if ttl, ok := minTTLOK(r); ok {
+		if d := time.Duration(ttl) * time.Second; d < maxAge {
+			maxAge = d
+		}
+	} else {
+		maxAge = forwardNegativeCacheAge
+	}
+
+	if maxAge <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	h.cacheMutex.Lock()
+	defer h.cacheMutex.Unlock()
+
+	h.cache.Add(key, &forwardCacheEntry{
+		msg:    r.Copy(),
+		added:  now,
+		expire: now.Add(maxAge),
+	})
+}
+
+// Like minTTL, but also returns false if the message contains no records.
+func minTTLOK(m *dns.Msg) (uint32, bool) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				return minTTL(m), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// Parses a comma-separated list of upstream resolvers. Each is of the form
+// [udp|tcp|tls://]host[:port][#servername]. Resolvers given without a scheme
+// (or as udp://) are queried using the same transport as the client's query.
+// For tls://, the server name used to verify the resolver's certificate
+// defaults to the host.
+func parseUpstreams(s string) (upstreams []*upstream, err error) {
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if !strings.Contains(a, "://") {
+			a = "udp://" + a
+		}
+
+		u, err := url.Parse(a)
+		if err != nil {
+			return nil, err
+		}
+
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host, port = strings.Trim(u.Host, "[]"), ""
+		}
+		if host == "" {
+			return nil, fmt.Errorf("upstream resolver must specify a host: %s", a)
+		}
+
+		up := &upstream{
+			client: &dns.Client{
+				Timeout: forwardTimeout,
+			},
+		}
+
+		switch u.Scheme {
+		case "udp":
+			up.tcpClient = &dns.Client{
+				Net:     "tcp",
+				Timeout: forwardTimeout,
+			}
+			if port == "" {
+				port = "53"
+			}
+		case "tcp":
+			up.client.Net = "tcp"
+			if port == "" {
+				port = "53"
+			}
+		case "tls":
+			up.client.Net = "tcp-tls"
+			if port == "" {
+				port = "853"
+			}
+
+			serverName := u.Fragment
+			if serverName == "" {
+				serverName = host
+			}
+			up.client.TLSConfig = &tls.Config{
+				ServerName: serverName,
+			}
+		default:
+			return nil, fmt.Errorf("unknown upstream resolver scheme: %s", a)
+		}
+
+		up.addr = net.JoinHostPort(host, port)
+		upstreams = append(upstreams, up)
+	}
+
+	return
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+var inBitZoneTests = []struct {
+	name   string
+	suffix string
+	in     bool
+}{
+	{"bit.", "bit", true},
+	{"example.bit.", "bit", true},
+	{"www.EXAMPLE.Bit.", "bit", true},
+	{"example.bit", "bit", true},
+
+	// Names which merely contain a "bit" label are not in the zone.
+	{"bit.ly.", "bit", false},
+	{"www.bit.ly.", "bit", false},
+	{"foo.bit.example.org.", "bit", false},
+	{"example.org.", "bit", false},
+	{"bitx.", "bit", false},
+	{".", "bit", false},
+
+	// Unless the canonical suffix says that they are.
+	{"foo.bit.example.org.", "bit.example.org", true},
+	{"bit.example.org.", "bit.example.org.", true},
+	{"example.bit.", "bit.example.org", true},
+	{"foo.bit.example.net.", "bit.example.org", false},
+
+	// Canonical suffixes which aren't below a "bit" label are ignored.
+	{"foo.example.org.", "example.org", false},
+}
+
+func TestInBitZone(t *testing.T) {
+	for _, tt := range inBitZoneTests {
+		in := inBitZone(tt.name, bitZones(tt.suffix))
+		if in != tt.in {
+			t.Errorf("%s (suffix %s): expected %v, got %v", tt.name, tt.suffix, tt.in, in)
+		}
+	}
+}
+
+var parseUpstreamsTests = []struct {
+	s         string
+	addrs     []string
+	nets      []string
+	tcpClient bool
+	err       bool
+}{
+	{"", nil, nil, false, false},
+	{"192.0.2.53", []string{"192.0.2.53:53"}, []string{""}, true, false},
+	{"udp://192.0.2.53:5353", []string{"192.0.2.53:5353"}, []string{""}, true, false},
+	{"tcp://192.0.2.53", []string{"192.0.2.53:53"}, []string{"tcp"}, false, false},
+	{"tls://1.1.1.1#cloudflare-dns.com", []string{"1.1.1.1:853"}, []string{"tcp-tls"}, false, false},
+	{"[2001:db8::53]", []string{"[2001:db8::53]:53"}, []string{""}, true, false},
+	{"tcp://[2001:db8::53]:5353", []string{"[2001:db8::53]:5353"}, []string{"tcp"}, false, false},
+	{" 192.0.2.53 , tcp://192.0.2.54 ", []string{"192.0.2.53:53", "192.0.2.54:53"}, []string{"", "tcp"}, true, false},
+	{"https://192.0.2.53", nil, nil, false, true},
+	{"tcp://", nil, nil, false, true},
+}
+
+func TestParseUpstreams(t *testing.T) {
+	for _, tt := range parseUpstreamsTests {
+		upstreams, err := parseUpstreams(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.s)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.s, err)
+			continue
+		}
+
+		if len(upstreams) != len(tt.addrs) {
+			t.Errorf("%q: expected %d upstreams, got %d", tt.s, len(tt.addrs), len(upstreams))
+			continue
+		}
+
+		for i, u := range upstreams {
+			if u.addr != tt.addrs[i] || u.client.Net != tt.nets[i] {
+				t.Errorf("%q: upstream %d: expected %s over %q, got %s over %q", tt.s, i, tt.addrs[i], tt.nets[i], u.addr, u.client.Net)
+			}
+		}
+
+		if len(upstreams) > 0 && (upstreams[0].tcpClient != nil) != tt.tcpClient {
+			t.Errorf("%q: expected TCP fallback client %v", tt.s, tt.tcpClient)
+		}
+	}
+
+	upstreams, err := parseUpstreams("tls://1.1.1.1#cloudflare-dns.com,tls://9.9.9.9")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, serverName := range []string{"cloudflare-dns.com", "9.9.9.9"} {
+		if upstreams[i].client.TLSConfig.ServerName != serverName {
+			t.Errorf("upstream %d: expected server name %s, got %s", i, serverName, upstreams[i].client.TLSConfig.ServerName)
+		}
+	}
+}
+
+func TestForwardPermitted(t *testing.T) {
+	allow, err := parseNetworks("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("couldn't parse networks: %v", err)
+	}
+
+	h := &forwardHandler{allow: allow}
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+
+	if !h.permitted(&recordingResponseWriter{dohResponseWriter: dohResponseWriter{remoteAddr: local}}) {
+		t.Errorf("query from an allowed network was not permitted")
+	}
+
+	if h.permitted(&recordingResponseWriter{dohResponseWriter: dohResponseWriter{remoteAddr: remote}}) {
+		t.Errorf("query from elsewhere was permitted")
+	}
+
+	// Behind a reverse proxy, DoH queries appear to come from the proxy.
+	if h.permitted(&dohResponseWriter{remoteAddr: local}) {
+		t.Errorf("DoH query was permitted")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeTXT)
+
+	r := &dns.Msg{}
+	r.SetReply(req)
+	r.SetEdns0(4096, false)
+	for i := 0; i < 10; i++ {
+		r.Answer = append(r.Answer, mustRR(t, `example.com. 600 IN TXT "`+strings.Repeat("x", 100)+`"`))
+	}
+
+	if tr := truncate(r, dns.MaxMsgSize); tr != r {
+		t.Errorf("response which fits was modified")
+	}
+
+	tr := truncate(r, dns.MinMsgSize)
+	if !tr.Truncated || len(tr.Answer) != 0 || tr.Len() > dns.MinMsgSize {
+		t.Errorf("response was not truncated: %v", tr)
+	}
+	if tr.IsEdns0() == nil {
+		t.Errorf("OPT record was removed from truncated response")
+	}
+	if r.Truncated || len(r.Answer) != 10 {
+		t.Errorf("original response was modified")
+	}
+}
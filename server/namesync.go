@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	extratypes "github.com/hlandau/ncbtcjsontypes"
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"strings"
+	"time"
+)
+
+// Number of events to request from name_sync per call.
+const nameSyncCount = 100
+
+// Number of recent blocks to remember for the purpose of recovering from
+// reorganisations.
+const nameSyncHistory = 16
+
+// Time to wait before retrying after a name_sync error.
+const nameSyncRetryInterval = 10 * time.Second
+
+// Follows the Namecoin blockchain via name_sync and evicts names from the
+// backend cache as they are updated. If a minimum number of confirmations is
+// required, names are evicted again once their update has enough
+// confirmations. If a zone store is given, the changes are also recorded
+// there once they have enough confirmations, and if a notifier is given,
+// secondaries are notified of them.
+type nameSync struct {
+	conn             namecoin.Conn
+	b                *backend.Backend
+	zone             *zoneStore
+	notifier         *notifier
+	timeout          time.Duration
+	minConfirmations int
+
+	// Recently seen blocks, oldest first.
+	blocks []syncBlock
+
+	// Names updated since the last block we saw, and their new values.
+	pending       []string
+	pendingValues map[string]string
+}
+
+type syncBlock struct {
+	hash   string
+	height int               // only known if there is a zone store
+	names  []string          // names updated in this block
+	values map[string]string // the values they were updated to
+
+	// Whether the updates in this block have been applied to the zone store.
+	applied bool
+}
+
+func newNameSync(conn namecoin.Conn, b *backend.Backend, zone *zoneStore, notifier *notifier, timeout time.Duration, minConfirmations int) *nameSync {
+	return &nameSync{
+		conn:             conn,
+		b:                b,
+		zone:             zone,
+		notifier:         notifier,
+		timeout:          timeout,
+		minConfirmations: minConfirmations,
+	}
+}
+
+func (ns *nameSync) Run() {
+	for {
+		err := ns.follow()
+		log.Errore(err, "name sync failed, retrying")
+		time.Sleep(nameSyncRetryInterval)
+	}
+}
+
+func (ns *nameSync) follow() error {
+	for {
+		if len(ns.blocks) == 0 {
+			err := ns.start()
+			if err != nil {
+				return err
+			}
+		}
+
+		// This waits for a new block if there are no events to return, so no
+		// timeout is used.
+		events, err := ns.conn.Sync(context.Background(), ns.blocks[len(ns.blocks)-1].hash, nameSyncCount, true)
+		if err == namecoin.ErrSyncNoSuchBlock {
+			ns.rewind()
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for i := range events {
+			ns.handleEvent(&events[i])
+		}
+	}
+}
+
+func (ns *nameSync) start() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ns.timeout)
+	defer cancel()
+
+	hash, err := ns.conn.CurBlockHash(ctx)
+	if err != nil {
+		return err
+	}
+
+	// We don't know which names were updated before now, so flush anything
+	// which might have been cached in the meantime.
+	ns.b.InvalidateAll()
+
+	// The zone is loaded as of the block we start from; changes after that
+	// are then seen via name_sync.
+	block := syncBlock{hash: hash, applied: true}
+	if ns.zone != nil {
+		hdr, err := ns.conn.BlockHeader(ctx, hash)
+		if err != nil {
+			return err
+		}
+
+		err = ns.zone.load(uint32(hdr.Height))
+		if err != nil {
+			return err
+		}
+
+		block.height = hdr.Height
+	}
+
+	ns.blocks = append(ns.blocks, block)
+	ns.pending = nil
+	ns.pendingValues = nil
+	log.Infof("name sync starting at block %s", hash)
+
+	// Names may have changed while we weren't following the chain.
+	if ns.notifier != nil {
+		ns.notifier.Changed()
+	}
+	return nil
+}
+
+func (ns *nameSync) handleEvent(ev *extratypes.NameSyncEvent) {
+	switch ev.Type {
+	case "update", "firstupdate":
+		ns.b.InvalidateName(ev.Name)
+		ns.pending = append(ns.pending, ev.Name)
+		if ns.pendingValues == nil {
+			ns.pendingValues = map[string]string{}
+		}
+		ns.pendingValues[ev.Name] = ev.Value
+
+	case "atblock":
+		ns.blocks = append(ns.blocks, syncBlock{
+			hash:   ev.BlockHash,
+			height: ns.blocks[len(ns.blocks)-1].height + 1,
+			names:  ns.pending,
+			values: ns.pendingValues,
+		})
+		ns.pending = nil
+		ns.pendingValues = nil
+
+		confirmations := ns.minConfirmations
+		if confirmations < 1 {
+			confirmations = 1
+		}
+
+		// The names updated in the block which has just reached the minimum
+		// number of confirmations can now be served with their new values.
+		if len(ns.blocks) >= confirmations {
+			ns.confirm(&ns.blocks[len(ns.blocks)-confirmations])
+		}
+
+		history := nameSyncHistory
+		if history < ns.minConfirmations {
+			history = ns.minConfirmations
+		}
+
+		if len(ns.blocks) > history {
+			ns.blocks = ns.blocks[len(ns.blocks)-history:]
+		}
+	}
+}
+
+// Called when a block reaches the minimum number of confirmations. Applies
+// the updates made in it to the zone store and notifies secondaries. The
+// block at which we started following the chain is already reflected in the
+// zone store, and so is skipped.
+func (ns *nameSync) confirm(block *syncBlock) {
+	if block.applied {
+		return
+	}
+
+	if ns.minConfirmations > 1 {
+		for _, name := range block.names {
+			ns.b.InvalidateName(name)
+		}
+	}
+
+	if ns.zone != nil {
+		for name, value := range block.values {
+			value := value
+			ns.zone.update(name, &value, block.height)
+		}
+		ns.zone.commit(block.height)
+	}
+	block.applied = true
+
+	if hasDomainName(block.names) && ns.notifier != nil {
+		ns.notifier.Changed()
+	}
+}
+
+// Returns true if any of the given names is a domain name (e.g. "d/example").
+func hasDomainName(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, "d/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Called when the block we are syncing from no longer exists in the main
+// chain. The names updated in that block may have reverted to an earlier
+// value, so they are evicted, and we resume from the block before it. If we
+// run out of known blocks, we start again from the current chain tip.
+func (ns *nameSync) rewind() {
+	orphan := ns.blocks[len(ns.blocks)-1]
+	ns.blocks = ns.blocks[0 : len(ns.blocks)-1]
+
+	log.Warnf("block %s was orphaned, rewinding name sync", orphan.hash)
+
+	var changed []string
+	changed = append(changed, orphan.names...)
+	changed = append(changed, ns.pending...)
+	for _, name := range changed {
+		ns.b.InvalidateName(name)
+	}
+
+	// Updates which had already been applied to the zone store are replaced
+	// with the values the names now have, which are retrieved when the next
+	// block is confirmed.
+	if orphan.applied && ns.zone != nil {
+		for _, name := range orphan.names {
+			ns.zone.update(name, nil, 0)
+		}
+	}
+
+	// The names are treated as having been updated in the next block we see,
+	// so that secondaries are notified of the change.
+	ns.pending = changed
+	ns.pendingValues = nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	extratypes "github.com/hlandau/ncbtcjsontypes"
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers every request as name_show would for the given name and value.
+func nameShowServer(name, value string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"result": map[string]interface{}{"name": name, "value": value, "height": 100, "expires_in": 1000},
+			"error":  nil,
+			"id":     1,
+		})
+	}))
+}
+
+// Returns a name sync watcher in the state in which start leaves it, having
+// started from block "b100" at height 100. names are the values served by
+// the backend, and may be changed to simulate updates.
+func newTestNameSync(t *testing.T, names map[string]string, zone *zoneStore, minConfirmations int) *nameSync {
+	b, err := backend.New(&backend.Config{FakeNames: names})
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+
+	ns := newNameSync(namecoin.Conn{}, b, zone, nil, time.Second, minConfirmations)
+	ns.blocks = []syncBlock{{hash: "b100", height: 100, applied: true}}
+	return ns
+}
+
+func updateEvent(name, value string) *extratypes.NameSyncEvent {
+	return &extratypes.NameSyncEvent{Type: "update", Name: name, Value: value}
+}
+
+func blockEvent(hash string) *extratypes.NameSyncEvent {
+	return &extratypes.NameSyncEvent{Type: "atblock", BlockHash: hash}
+}
+
+// Returns the address served for example.bit.
+func lookupExample(t *testing.T, b *backend.Backend) string {
+	rrs, err := b.Lookup("example.bit.")
+	if err != nil {
+		t.Fatalf("couldn't look up example.bit.: %v", err)
+	}
+
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+
+	return ""
+}
+
+func TestNameSyncInvalidation(t *testing.T) {
+	names := map[string]string{"d/example": `{"ip": "192.0.2.1"}`}
+	ns := newTestNameSync(t, names, nil, 2)
+	lookupExample(t, ns.b)
+
+	// The cached value is evicted as soon as the name is updated...
+	names["d/example"] = `{"ip": "192.0.2.2"}`
+	ns.handleEvent(updateEvent("d/example", names["d/example"]))
+	if addr := lookupExample(t, ns.b); addr != "192.0.2.2" {
+		t.Errorf("name was not evicted when updated: got %s", addr)
+	}
+
+	// ...and again once the update has enough confirmations, but not before.
+	names["d/example"] = `{"ip": "192.0.2.3"}`
+	ns.handleEvent(blockEvent("b101"))
+	if addr := lookupExample(t, ns.b); addr != "192.0.2.2" {
+		t.Errorf("name was evicted before the update was confirmed: got %s", addr)
+	}
+
+	ns.handleEvent(blockEvent("b102"))
+	if addr := lookupExample(t, ns.b); addr != "192.0.2.3" {
+		t.Errorf("name was not evicted when the update was confirmed: got %s", addr)
+	}
+}
+
+func TestNameSyncZone(t *testing.T) {
+	zs := newLoadedZoneStore(t, 100)
+	ns := newTestNameSync(t, nil, zs, 2)
+
+	// The block we started from is already reflected in the zone, so it
+	// isn't applied when the block after it confirms it.
+	ns.handleEvent(updateEvent("d/example", `{"ip": "192.0.2.1"}`))
+	ns.handleEvent(blockEvent("b101"))
+	if zs.serial != 100 || len(zs.records) != 0 {
+		t.Errorf("zone changed before any update was confirmed: serial %d, %v", zs.serial, zs.records)
+	}
+
+	ns.handleEvent(blockEvent("b102"))
+	if zs.serial != 101 || len(zs.records["d/example"]) != 1 {
+		t.Errorf("confirmed update was not applied at serial 101: serial %d, %v", zs.serial, zs.records)
+	}
+
+	ns.handleEvent(blockEvent("b103"))
+	if zs.serial != 102 || len(zs.records["d/example"]) != 1 {
+		t.Errorf("update was not retained at serial 102: serial %d, %v", zs.serial, zs.records)
+	}
+}
+
+func TestNameSyncRewind(t *testing.T) {
+	oldValue := `{"ip": "192.0.2.1"}`
+	srv := nameShowServer("d/example", oldValue)
+	defer srv.Close()
+
+	zs := newLoadedZoneStore(t, 100)
+	zs.conn = namecoin.Conn{Server: strings.TrimPrefix(srv.URL, "http://")}
+
+	names := map[string]string{"d/example": `{"ip": "192.0.2.2"}`}
+	ns := newTestNameSync(t, names, zs, 1)
+
+	ns.handleEvent(updateEvent("d/example", names["d/example"]))
+	ns.handleEvent(blockEvent("b101"))
+	if addr := lookupExample(t, ns.b); addr != "192.0.2.2" {
+		t.Fatalf("update was not served: got %s", addr)
+	}
+	if zs.values["d/example"] != names["d/example"] {
+		t.Fatalf("update was not applied to the zone: %v", zs.values)
+	}
+
+	// Block b101 is orphaned, so the name reverts to its earlier value.
+	names["d/example"] = oldValue
+	ns.rewind()
+	if len(ns.blocks) != 1 || ns.blocks[0].hash != "b100" {
+		t.Fatalf("expected to resume from b100, got %v", ns.blocks)
+	}
+	if addr := lookupExample(t, ns.b); addr != "192.0.2.1" {
+		t.Errorf("name updated in the orphaned block was not evicted: got %s", addr)
+	}
+
+	// The zone is corrected with the current value once the block replacing
+	// it is confirmed.
+	ns.handleEvent(blockEvent("b101'"))
+	if zs.values["d/example"] != oldValue || zs.serial != 102 {
+		t.Errorf("zone was not corrected at serial 102: serial %d, %v", zs.serial, zs.values)
+	}
+	if len(ns.blocks) != 2 || ns.blocks[1].height != 101 {
+		t.Errorf("replacement block has wrong height: %v", ns.blocks)
+	}
+
+	// Rewinding past the block we started from leaves nothing to resume
+	// from, so name sync starts again from the current chain tip.
+	ns.rewind()
+	ns.rewind()
+	if len(ns.blocks) != 0 {
+		t.Errorf("expected name sync to restart, got %v", ns.blocks)
+	}
+}
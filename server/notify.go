@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of times to send a NOTIFY message to a secondary before giving up.
+const notifyAttempts = 5
+
+// Time to wait before the first retry of a NOTIFY message. This doubles with
+// each retry.
+const notifyRetryInterval = 5 * time.Second
+
+// Time to wait for a secondary to acknowledge a NOTIFY message.
+const notifyTimeout = 5 * time.Second
+
+// Sends NOTIFY messages (RFC 1996) for the .bit zone to secondaries when the
+// zone changes.
+type notifier struct {
+	b           *backend.Backend
+	secondaries []string
+	client      *dns.Client
+
+	// Signalled when the zone changes. Changes which occur while secondaries
+	// are being notified of a previous change are coalesced.
+	changed chan struct{}
+}
+
+func newNotifier(b *backend.Backend, secondaries []string) *notifier {
+	return &notifier{
+		b:           b,
+		secondaries: secondaries,
+		client: &dns.Client{
+			Timeout: notifyTimeout,
+		},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Called when the zone changes. Does not block.
+func (n *notifier) Changed() {
+	select {
+	case n.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Notifies the secondaries each time the zone changes. Does not return.
+func (n *notifier) Run() {
+	for range n.changed {
+		n.notifyAll()
+	}
+}
+
+func (n *notifier) notifyAll() {
+	// Secondaries may use the SOA to avoid querying for it.
+	var soa dns.RR
+	apex, err := n.b.Lookup(xfrZone)
+	if err == nil {
+		for _, rr := range apex {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				soa = rr
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range n.secondaries {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			n.notify(addr, soa)
+		}(addr)
+	}
+
+	wg.Wait()
+}
+
+// Sends a NOTIFY message to a secondary, retrying until it is acknowledged.
+func (n *notifier) notify(addr string, soa dns.RR) {
+	interval := notifyRetryInterval
+
+	var err error
+	for i := 0; i < notifyAttempts; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+			interval *= 2
+		}
+
+		err = n.sendNotify(addr, soa)
+		if err == nil {
+			log.Debugf("notified %s of zone change", addr)
+			return
+		}
+
+		log.Infoe(err, "failed to notify ", addr, " of zone change, retrying")
+	}
+
+	log.Warne(err, "giving up notifying ", addr, " of zone change")
+}
+
+func (n *notifier) sendNotify(addr string, soa dns.RR) error {
+	m := &dns.Msg{}
+	m.SetNotify(xfrZone)
+	if soa != nil {
+		m.Answer = []dns.RR{soa}
+	}
+
+	r, _, err := n.client.Exchange(m, addr)
+	if err != nil {
+		return err
+	}
+
+	if r.Opcode != dns.OpcodeNotify || r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("secondary responded with %s", dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
+
+// Parses a comma-separated list of secondaries of the form host or host:port.
+func parseSecondaries(s string) (addrs []string) {
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, "53")
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	return
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Validity period of the self-signed certificate generated when no
+// certificate is configured for DNS-over-TLS.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// Opens the DNS-over-TLS (RFC 7858) listener.
+func (s *Server) listenTLS() (net.Listener, error) {
+	var cert tls.Certificate
+	var err error
+	if s.cfg.DoTCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.cfg.cpath(s.cfg.DoTCertFile), s.cfg.cpath(s.cfg.DoTKeyFile))
+	} else {
+		cert, err = s.selfSignedCertificate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", s.cfg.DoTBind)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// Generates a self-signed certificate for this server. It is valid only for
+// the duration of this process.
+func (s *Server) selfSignedCertificate() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	name := strings.TrimSuffix(s.ServerName(), ".")
+	notBefore := time.Now().Add(-1 * time.Hour)
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: name,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{name},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	log.Info("generated self-signed certificate for DNS-over-TLS")
+
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+	}, nil
+}
@@ -1,19 +1,24 @@
 package server
 
 import "net/http"
+import "context"
 import "html/template"
 import "github.com/namecoin/ncdns/util"
 import "github.com/namecoin/ncdns/ncdomain"
+import "github.com/namecoin/ncdns/namecoin"
+import "github.com/namecoin/ncdns/backend"
 import "github.com/miekg/dns"
 import "github.com/kr/pretty"
 import "path/filepath"
 import "time"
 import "strings"
+import "sort"
 import "fmt"
 
 var layoutTpl *template.Template
 var mainPageTpl *template.Template
 var lookupPageTpl *template.Template
+var errorsPageTpl *template.Template
 
 func (s *Server) initTemplates() error {
 	if lookupPageTpl != nil {
@@ -36,6 +41,11 @@ func (s *Server) initTemplates() error {
 		return err
 	}
 
+	errorsPageTpl, err = deriveTemplate(s.tplFilename("errors"))
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -70,6 +80,7 @@ type layoutInfo struct {
 	CanonicalSuffixHTML  template.HTML
 	TLD                  string
 	HasDNSSEC            bool
+	Chain                chainState
 }
 
 func (ws *webServer) layoutInfo() *layoutInfo {
@@ -93,6 +104,7 @@ func (ws *webServer) layoutInfo() *layoutInfo {
 		CanonicalSuffixHTML:  template.HTML(cshtml),
 		TLD:                  tld,
 		HasDNSSEC:            ws.s.cfg.ZonePublicKey != "",
+		Chain:                ws.s.chainMonitor.State(),
 	}
 
 	return li
@@ -116,6 +128,8 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		NameParseError error
 		ExistenceError error
 		Expired        bool
+		ExpiresIn      int
+		Height         int
 		Value          string
 		NCValue        *ncdomain.Value
 		NCValueFmt     fmt.Formatter
@@ -141,13 +155,22 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 	info.Advanced = (req.FormValue("adv") != "")
 	info.DomainName = info.BareName + ".bit."
 
+	ctx, cancel := context.WithTimeout(req.Context(), ws.s.namecoinTimeout())
+	defer cancel()
+
 	info.JSONValue = req.FormValue("value")
 	info.Value = strings.Trim(info.JSONValue, " \t\r\n")
 	if info.Value == "" {
-		info.Value, info.ExistenceError = ws.s.namecoinConn.Query(info.NamecoinName)
+		var ni *namecoin.NameInfo
+		ni, info.ExistenceError = ws.s.namecoinConn.Query(ctx, info.NamecoinName)
 		if info.ExistenceError != nil {
 			return
 		}
+
+		info.Value = ni.Value
+		info.Expired = ni.Expired
+		info.ExpiresIn = ni.ExpiresIn
+		info.Height = ni.Height
 	} else {
 		info.JSONMode = true
 	}
@@ -160,7 +183,16 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	info.NCValue = ncdomain.ParseValue(info.NamecoinName, info.Value, ws.resolveFunc, errorFunc)
+	resolveFunc := func(name string) (string, error) {
+		ni, err := ws.s.namecoinConn.Query(ctx, name)
+		if err != nil {
+			return "", err
+		}
+
+		return ni.Value, nil
+	}
+
+	info.NCValue = ncdomain.ParseValue(info.NamecoinName, info.Value, resolveFunc, errorFunc)
 	if info.NCValue == nil {
 		return
 	}
@@ -173,10 +205,41 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (ws *webServer) resolveFunc(name string) (string, error) {
-	return ws.s.namecoinConn.Query(name)
+type nameParseErrors struct {
+	Name   string
+	Errors []backend.ParseError
 }
 
+// Lists the cached names whose values had errors or warnings.
+func (ws *webServer) handleErrors(rw http.ResponseWriter, req *http.Request) {
+	info := struct {
+		layoutInfo
+		Policy string
+		Names  []nameParseErrors
+	}{
+		layoutInfo: *ws.layoutInfo(),
+		Policy:     ws.s.cfg.ParseErrorPolicy,
+	}
+
+	defer func() {
+		err := errorsPageTpl.Execute(rw, &info)
+		log.Infoe(err, "errors page tpl")
+	}()
+
+	m := ws.s.backend.ParseErrors()
+	for name, errs := range m {
+		info.Names = append(info.Names, nameParseErrors{Name: name, Errors: errs})
+	}
+
+	sort.Sort(byName(info.Names))
+}
+
+type byName []nameParseErrors
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
 func (ws *webServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	rw.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline';")
 	rw.Header().Set("X-Frame-Options", "DENY")
@@ -213,6 +276,9 @@ func webStart(listenAddr string, server *Server) error {
 
 	ws.sm.HandleFunc("/", ws.handleRoot)
 	ws.sm.HandleFunc("/lookup", ws.handleLookup)
+	ws.sm.HandleFunc("/errors", ws.handleErrors)
+	ws.sm.HandleFunc("/dns-query", ws.handleDNSQuery)
+	ws.sm.HandleFunc("/resolve", ws.handleResolve)
 
 	s := http.Server{
 		Addr:    listenAddr,
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// Approximate maximum size of each message sent during a zone transfer.
+const xfrMessageSize = 16000
+
+// The apex of the zone which may be transferred.
+const xfrZone = "bit."
+
+// Answers AXFR and IXFR requests for the .bit zone, passing all other
+// requests on to the next handler.
+type xfrHandler struct {
+	s    *Server
+	next dns.Handler
+
+	// Networks from which transfers are permitted.
+	allow []*net.IPNet
+
+	// If true, transfer requests must be signed with one of the configured
+	// TSIG keys.
+	requireTSIG bool
+}
+
+func (h *xfrHandler) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || (req.Question[0].Qtype != dns.TypeAXFR && req.Question[0].Qtype != dns.TypeIXFR) {
+		h.next.ServeDNS(rw, req)
+		return
+	}
+
+	q := req.Question[0]
+	if !h.permitted(rw, req) {
+		log.Infof("refused %s of %s from %v", dns.TypeToString[q.Qtype], q.Name, rw.RemoteAddr())
+		h.writeError(rw, req, dns.RcodeRefused)
+		return
+	}
+
+	if !strings.EqualFold(q.Name, xfrZone) {
+		h.writeError(rw, req, dns.RcodeNotAuth)
+		return
+	}
+
+	// Transfers are only possible over TCP.
+	if _, ok := rw.RemoteAddr().(*net.TCPAddr); !ok {
+		h.writeError(rw, req, dns.RcodeRefused)
+		return
+	}
+
+	err := h.transfer(rw, req)
+	if err != nil {
+		log.Warne(err, "zone transfer to ", rw.RemoteAddr(), " failed")
+	}
+}
+
+func (h *xfrHandler) permitted(rw dns.ResponseWriter, req *dns.Msg) bool {
+	if h.requireTSIG && (req.IsTsig() == nil || rw.TsigStatus() != nil) {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(rw.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	for _, n := range h.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *xfrHandler) writeError(rw dns.ResponseWriter, req *dns.Msg, rcode int) {
+	m := &dns.Msg{}
+	m.SetRcode(req, rcode)
+	rw.WriteMsg(m)
+}
+
+func (h *xfrHandler) transfer(rw dns.ResponseWriter, req *dns.Msg) error {
+	zs := h.s.zone
+	if zs == nil {
+		return fmt.Errorf("zone is not available for transfer")
+	}
+
+	apex, soa, err := h.apexRRs()
+	if err != nil {
+		h.writeError(rw, req, dns.RcodeServerFailure)
+		return err
+	}
+
+	out := &xfrWriter{rw: rw, req: req}
+
+	if req.Question[0].Qtype == dns.TypeIXFR {
+		if clientSerial, ok := ixfrSerial(req); ok {
+			serial, deltas, ok := zs.changesSince(clientSerial)
+			if ok {
+				return h.writeIXFR(out, soa, serial, deltas)
+			}
+		}
+
+		// If the changes can't be provided, the whole zone is sent instead.
+	}
+
+	serial, rrs, ok := zs.snapshot()
+	if !ok {
+		h.writeError(rw, req, dns.RcodeServerFailure)
+		return fmt.Errorf("zone has not yet been loaded")
+	}
+
+	soa = withSerial(soa, serial)
+	out.add(soa)
+	for _, rr := range apex {
+		out.add(rr)
+	}
+	for _, rr := range rrs {
+		out.add(rr)
+	}
+	out.add(soa)
+	return out.flush()
+}
+
+// Sends an incremental zone transfer in the format described in RFC 1995.
+func (h *xfrHandler) writeIXFR(out *xfrWriter, soa *dns.SOA, serial uint32, deltas []zoneDelta) error {
+	cur := withSerial(soa, serial)
+	out.add(cur)
+
+	// If the client is up to date, only the current SOA is sent.
+	if len(deltas) == 0 {
+		return out.flush()
+	}
+
+	for i := range deltas {
+		out.add(withSerial(soa, deltas[i].from))
+		for _, rr := range deltas[i].deleted {
+			out.add(rr)
+		}
+
+		out.add(withSerial(soa, deltas[i].to))
+		for _, rr := range deltas[i].added {
+			out.add(rr)
+		}
+	}
+
+	out.add(cur)
+	return out.flush()
+}
+
+// Returns the records at the zone apex other than the SOA, and the SOA.
+func (h *xfrHandler) apexRRs() (rrs []dns.RR, soa *dns.SOA, err error) {
+	apex, err := h.s.backend.Lookup(xfrZone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, rr := range apex {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			continue
+		}
+
+		rrs = append(rrs, rr)
+
+		// Include the addresses of nameservers within the zone, such as the
+		// psuedo-hostname used when no nameservers are configured.
+		if ns, ok := rr.(*dns.NS); ok {
+			if dns.IsSubDomain(xfrZone, ns.Ns) {
+				glue, err := h.s.backend.Lookup(ns.Ns)
+				if err == nil {
+					rrs = append(rrs, glue...)
+				}
+			}
+		}
+	}
+
+	if soa == nil {
+		return nil, nil, fmt.Errorf("no SOA at zone apex")
+	}
+
+	return rrs, soa, nil
+}
+
+func withSerial(soa *dns.SOA, serial uint32) *dns.SOA {
+	s := *soa
+	s.Serial = serial
+	return &s
+}
+
+// Returns the serial which the client of an IXFR request has, which is in the
+// SOA record in the authority section of the request.
+func ixfrSerial(req *dns.Msg) (uint32, bool) {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+
+	return 0, false
+}
+
+// Writes the records of a zone transfer as a series of messages.
+type xfrWriter struct {
+	rw  dns.ResponseWriter
+	req *dns.Msg
+	msg *dns.Msg
+	err error
+}
+
+func (w *xfrWriter) add(rr dns.RR) {
+	if w.msg == nil {
+		w.msg = &dns.Msg{}
+		w.msg.SetReply(w.req)
+		w.msg.Authoritative = true
+	}
+
+	w.msg.Answer = append(w.msg.Answer, rr)
+	if w.msg.Len() >= xfrMessageSize {
+		w.flush()
+	}
+}
+
+func (w *xfrWriter) flush() error {
+	if w.msg == nil || w.err != nil {
+		return w.err
+	}
+
+	if t := w.req.IsTsig(); t != nil {
+		w.msg.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+
+	w.err = w.rw.WriteMsg(w.msg)
+	w.msg = nil
+	return w.err
+}
+
+// Parses a comma-separated list of IP addresses and networks in CIDR form.
+func parseNetworks(s string) (nets []*net.IPNet, err error) {
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("Couldn't parse IP: %s", a)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return
+}
+
+// Parses a comma-separated list of TSIG keys of the form "name:secret", where
+// the secret is base64-encoded, into the form used by dns.Server.
+func parseTSIGKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("TSIG key must be of the form name:secret: %s", k)
+		}
+
+		keys[dns.Fqdn(strings.ToLower(parts[0]))] = parts[1]
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"gopkg.in/hlandau/madns.v1/merr"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of names to request from name_scan per call when loading the zone.
+const zoneScanCount = 1000
+
+// Number of changes to the zone to remember for the purposes of IXFR.
+const zoneJournalLength = 1000
+
+// Number of blocks after the block in which a name was last updated at which
+// it expires.
+const nameExpiryDepth = 36000
+
+// A copy of the records of the .bit zone, kept for the purposes of zone
+// transfers. The zone is loaded by scanning all names, and then kept up to
+// date by the name sync watcher, which records the changes made in each block
+// in a journal from which IXFR requests are answered.
+type zoneStore struct {
+	conn    namecoin.Conn
+	b       *backend.Backend
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	loaded bool
+	serial uint32
+
+	// The records and value of each name, the height at which each name which
+	// has not yet expired will expire, and the names which reference each
+	// name via "import" or "delegate", so that they can be updated when it
+	// changes.
+	records    map[string][]dns.RR
+	values     map[string]string
+	expires    map[string]int
+	dependents map[string]map[string]struct{}
+
+	// Changes to the zone, oldest first.
+	journal []zoneDelta
+
+	// Names updated since the last commit. A nil value means that the value
+	// must be retrieved.
+	pending map[string]*zoneUpdate
+}
+
+// The new value of a name, and the height at which it will expire.
+type zoneUpdate struct {
+	value   string
+	expires int
+}
+
+// The changes made to the zone between two serials.
+type zoneDelta struct {
+	from, to       uint32
+	deleted, added []dns.RR
+}
+
+func newZoneStore(conn namecoin.Conn, b *backend.Backend, timeout time.Duration) *zoneStore {
+	return &zoneStore{
+		conn:    conn,
+		b:       b,
+		timeout: timeout,
+	}
+}
+
+// Loads the zone afresh by scanning all names. serial is the serial of the
+// zone as loaded, which should be the height of the block at which the name
+// sync watcher starts following the chain; if the zone has been loaded
+// before and this would not increase its serial, the serial is increased by
+// one instead. Subsequent changes are recorded by calling update and commit.
+func (zs *zoneStore) load(serial uint32) error {
+	records := map[string][]dns.RR{}
+	values := map[string]string{}
+	expires := map[string]int{}
+	dependents := map[string]map[string]struct{}{}
+
+	currentName := "d/"
+	continuing := 0
+
+	for {
+		results, err := zs.conn.Scan(context.Background(), currentName, zoneScanCount)
+		if err != nil {
+			return err
+		}
+
+		if len(results) <= continuing {
+			break
+		}
+
+		// scan is [x,y] not (x,y], so exclude the first result
+		if continuing != 0 {
+			results = results[1:]
+		} else {
+			continuing = 1
+		}
+
+		for i := range results {
+			r := &results[i]
+			if !strings.HasPrefix(r.Name, "d/") {
+				continue
+			}
+
+			info := &namecoin.NameInfo{
+				Name:      r.Name,
+				Value:     r.Value,
+				ExpiresIn: r.ExpiresIn,
+				Expired:   r.ExpiresIn <= 0,
+			}
+
+			rrs, deps, err := zs.b.ZoneRRs(info)
+			if err != nil {
+				if err != merr.ErrNoSuchDomain {
+					log.Infoe(err, "not transferring ", r.Name)
+				}
+				continue
+			}
+
+			records[r.Name] = rrs
+			values[r.Name] = r.Value
+			if r.ExpiresIn > 0 {
+				expires[r.Name] = int(serial) + r.ExpiresIn
+			}
+			addDependent(dependents, r.Name, deps)
+		}
+
+		currentName = results[len(results)-1].Name
+	}
+
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	if zs.loaded && serial <= zs.serial {
+		serial = zs.serial + 1
+	}
+
+	zs.loaded = true
+	zs.serial = serial
+	zs.records = records
+	zs.values = values
+	zs.expires = expires
+	zs.dependents = dependents
+	zs.journal = nil
+	zs.pending = map[string]*zoneUpdate{}
+	zs.b.AdvanceSerial(serial)
+
+	log.Infof("loaded zone for transfer at serial %d (%d names)", serial, len(records))
+	return nil
+}
+
+func addDependent(dependents map[string]map[string]struct{}, name string, deps []string) {
+	for _, dep := range deps {
+		m, ok := dependents[dep]
+		if !ok {
+			m = map[string]struct{}{}
+			dependents[dep] = m
+		}
+		m[name] = struct{}{}
+	}
+}
+
+// Records that a name has been updated to the given value in the block at
+// the given height. If value is nil, the new value is retrieved from
+// namecoind. The change takes effect when commit is next called.
+func (zs *zoneStore) update(name string, value *string, height int) {
+	if !strings.HasPrefix(name, "d/") {
+		return
+	}
+
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	if !zs.loaded {
+		return
+	}
+
+	if value == nil {
+		zs.pending[name] = nil
+	} else {
+		zs.pending[name] = &zoneUpdate{value: *value, expires: height + nameExpiryDepth}
+	}
+}
+
+// Applies the updates recorded since the last commit and removes the names
+// which have expired as of the block at the given height, and records the
+// resulting changes in the journal. The serial becomes the height, or is
+// incremented if that would not increase it.
+//
+// The records of the names updated or expired, and of names which reference
+// them, are regenerated.
+func (zs *zoneStore) commit(height int) {
+	zs.mutex.Lock()
+	if !zs.loaded {
+		zs.mutex.Unlock()
+		return
+	}
+
+	pending := zs.pending
+	zs.pending = map[string]*zoneUpdate{}
+
+	// Names which have expired are treated as updated to their current value,
+	// so that they are removed unless expired names are served.
+	for name, expires := range zs.expires {
+		if _, ok := pending[name]; !ok && expires <= height {
+			pending[name] = &zoneUpdate{value: zs.values[name], expires: expires}
+		}
+	}
+
+	// Regenerate the records of every name which references an updated name,
+	// using its current value.
+	for name := range pending {
+		zs.addDependentsLocked(pending, name, 0)
+	}
+	zs.mutex.Unlock()
+
+	// Generate the new records without holding the lock, as this may involve
+	// RPC calls.
+	type result struct {
+		rrs     []dns.RR
+		deps    []string
+		value   string
+		expires int
+		ok      bool
+	}
+
+	// Names which couldn't be retrieved are left as they are and retried at
+	// the next commit.
+	var retry []string
+
+	results := map[string]result{}
+	for name, u := range pending {
+		var info *namecoin.NameInfo
+		var expires int
+		if u != nil {
+			info = &namecoin.NameInfo{
+				Name:    name,
+				Value:   u.value,
+				Expired: u.expires <= height,
+			}
+			expires = u.expires
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), zs.timeout)
+			ni, err := zs.conn.Query(ctx, name)
+			cancel()
+			if err == merr.ErrNoSuchDomain {
+				results[name] = result{}
+				continue
+			} else if err != nil {
+				log.Warne(err, "couldn't retrieve updated name ", name, " for zone transfer")
+				retry = append(retry, name)
+				continue
+			}
+			info = ni
+			expires = height + ni.ExpiresIn
+		}
+
+		rrs, deps, err := zs.b.ZoneRRs(info)
+		if err != nil {
+			if err != merr.ErrNoSuchDomain {
+				log.Infoe(err, "not transferring ", name)
+			}
+			results[name] = result{}
+			continue
+		}
+
+		results[name] = result{rrs: rrs, deps: deps, value: info.Value, expires: expires, ok: true}
+	}
+
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	delta := zoneDelta{
+		from: zs.serial,
+		to:   zs.serial + 1,
+	}
+	if uint32(height) > delta.to {
+		delta.to = uint32(height)
+	}
+
+	for name, r := range results {
+		deleted, added := diffRRs(zs.records[name], r.rrs)
+		delta.deleted = append(delta.deleted, deleted...)
+		delta.added = append(delta.added, added...)
+
+		if r.ok {
+			zs.records[name] = r.rrs
+			zs.values[name] = r.value
+			addDependent(zs.dependents, name, r.deps)
+		} else {
+			delete(zs.records, name)
+			delete(zs.values, name)
+		}
+
+		if r.ok && r.expires > height {
+			zs.expires[name] = r.expires
+		} else {
+			delete(zs.expires, name)
+		}
+	}
+
+	for _, name := range retry {
+		if _, ok := zs.pending[name]; !ok {
+			zs.pending[name] = nil
+		}
+	}
+
+	zs.serial = delta.to
+	zs.journal = append(zs.journal, delta)
+	if len(zs.journal) > zoneJournalLength {
+		zs.journal = zs.journal[len(zs.journal)-zoneJournalLength:]
+	}
+
+	zs.b.AdvanceSerial(zs.serial)
+}
+
+// Adds the names which reference the given name to pending, recursively.
+// Must be called with mutex held.
+func (zs *zoneStore) addDependentsLocked(pending map[string]*zoneUpdate, name string, depth int) {
+	if depth > 4 {
+		return
+	}
+
+	for dep := range zs.dependents[name] {
+		if _, ok := pending[dep]; ok {
+			continue
+		}
+
+		value, ok := zs.values[dep]
+		if !ok {
+			continue
+		}
+
+		pending[dep] = &zoneUpdate{value: value, expires: zs.expires[dep]}
+		zs.addDependentsLocked(pending, dep, depth+1)
+	}
+}
+
+// Returns the records in old but not in new, and those in new but not in
+// old.
+func diffRRs(old, new []dns.RR) (deleted, added []dns.RR) {
+	oldSet := map[string]struct{}{}
+	for _, rr := range old {
+		oldSet[rr.String()] = struct{}{}
+	}
+
+	newSet := map[string]struct{}{}
+	for _, rr := range new {
+		newSet[rr.String()] = struct{}{}
+		if _, ok := oldSet[rr.String()]; !ok {
+			added = append(added, rr)
+		}
+	}
+
+	for _, rr := range old {
+		if _, ok := newSet[rr.String()]; !ok {
+			deleted = append(deleted, rr)
+		}
+	}
+
+	return
+}
+
+// Returns the serial of the zone and all of its records other than those at
+// the apex. Returns false if the zone has not been loaded.
+func (zs *zoneStore) snapshot() (serial uint32, rrs []dns.RR, ok bool) {
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	if !zs.loaded {
+		return 0, nil, false
+	}
+
+	for _, nrrs := range zs.records {
+		rrs = append(rrs, nrrs...)
+	}
+
+	return zs.serial, rrs, true
+}
+
+// Returns the serial of the zone and the changes made to it since the given
+// serial. Returns false if the journal does not extend back that far.
+func (zs *zoneStore) changesSince(serial uint32) (uint32, []zoneDelta, bool) {
+	zs.mutex.Lock()
+	defer zs.mutex.Unlock()
+
+	if !zs.loaded {
+		return 0, nil, false
+	}
+
+	if serial == zs.serial {
+		return zs.serial, nil, true
+	}
+
+	for i := range zs.journal {
+		if zs.journal[i].from == serial {
+			deltas := make([]zoneDelta, len(zs.journal)-i)
+			copy(deltas, zs.journal[i:])
+			return zs.serial, deltas, true
+		}
+	}
+
+	return 0, nil, false
+}
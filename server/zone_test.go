@@ -0,0 +1,247 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/namecoin"
+	"testing"
+	"time"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("couldn't parse %q: %v", s, err)
+	}
+
+	return rr
+}
+
+func rrStrings(rrs []dns.RR) map[string]struct{} {
+	m := map[string]struct{}{}
+	for _, rr := range rrs {
+		m[rr.String()] = struct{}{}
+	}
+
+	return m
+}
+
+func TestDiffRRs(t *testing.T) {
+	a := mustRR(t, "example.bit. 600 IN A 192.0.2.1")
+	b := mustRR(t, "example.bit. 600 IN A 192.0.2.2")
+	c := mustRR(t, "www.example.bit. 600 IN A 192.0.2.3")
+
+	tests := []struct {
+		old, new       []dns.RR
+		deleted, added []dns.RR
+	}{
+		{nil, nil, nil, nil},
+		{nil, []dns.RR{a, c}, nil, []dns.RR{a, c}},
+		{[]dns.RR{a, c}, nil, []dns.RR{a, c}, nil},
+		{[]dns.RR{a, c}, []dns.RR{a, c}, nil, nil},
+		{[]dns.RR{a, c}, []dns.RR{b, c}, []dns.RR{a}, []dns.RR{b}},
+	}
+
+	for i, tt := range tests {
+		deleted, added := diffRRs(tt.old, tt.new)
+		if len(deleted) != len(tt.deleted) || len(added) != len(tt.added) {
+			t.Errorf("%d: expected -%v +%v, got -%v +%v", i, tt.deleted, tt.added, deleted, added)
+			continue
+		}
+
+		deletedSet, addedSet := rrStrings(deleted), rrStrings(added)
+		for _, rr := range tt.deleted {
+			if _, ok := deletedSet[rr.String()]; !ok {
+				t.Errorf("%d: %v was not deleted", i, rr)
+			}
+		}
+		for _, rr := range tt.added {
+			if _, ok := addedSet[rr.String()]; !ok {
+				t.Errorf("%d: %v was not added", i, rr)
+			}
+		}
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	zs := &zoneStore{
+		loaded: true,
+		serial: 13,
+		journal: []zoneDelta{
+			{from: 10, to: 11},
+			{from: 11, to: 12},
+			{from: 12, to: 13},
+		},
+	}
+
+	tests := []struct {
+		serial  uint32
+		ok      bool
+		ndeltas int
+	}{
+		{13, true, 0},
+		{12, true, 1},
+		{10, true, 3},
+		{9, false, 0},
+		{14, false, 0},
+	}
+
+	for _, tt := range tests {
+		serial, deltas, ok := zs.changesSince(tt.serial)
+		if ok != tt.ok || len(deltas) != tt.ndeltas {
+			t.Errorf("%d: expected %v with %d deltas, got %v with %d", tt.serial, tt.ok, tt.ndeltas, ok, len(deltas))
+			continue
+		}
+
+		if ok && serial != 13 {
+			t.Errorf("%d: expected serial 13, got %d", tt.serial, serial)
+		}
+
+		if ok && len(deltas) > 0 && (deltas[0].from != tt.serial || deltas[len(deltas)-1].to != 13) {
+			t.Errorf("%d: deltas don't span to the current serial: %v", tt.serial, deltas)
+		}
+	}
+
+	if _, _, ok := (&zoneStore{}).changesSince(0); ok {
+		t.Errorf("changes were returned for a zone which hasn't been loaded")
+	}
+}
+
+// Records every message written to it.
+type recordingResponseWriter struct {
+	dohResponseWriter
+	msgs []*dns.Msg
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func TestWriteIXFR(t *testing.T) {
+	soa := mustRR(t, "bit. 600 IN SOA this.x.bit. hostmaster.x.bit. 1 600 600 7200 600").(*dns.SOA)
+	a := mustRR(t, "example.bit. 600 IN A 192.0.2.1")
+	b := mustRR(t, "example.bit. 600 IN A 192.0.2.2")
+	c := mustRR(t, "www.example.bit. 600 IN A 192.0.2.3")
+
+	deltas := []zoneDelta{
+		{from: 10, to: 11, deleted: []dns.RR{a}, added: []dns.RR{b}},
+		{from: 11, to: 12, added: []dns.RR{c}},
+	}
+
+	// The SOA of each serial is followed by the records deleted from (for
+	// the old serial) or added to (for the new serial) the zone, and the
+	// whole is enclosed by the current SOA.
+	expected := []string{
+		withSerial(soa, 12).String(),
+		withSerial(soa, 10).String(),
+		a.String(),
+		withSerial(soa, 11).String(),
+		b.String(),
+		withSerial(soa, 11).String(),
+		withSerial(soa, 12).String(),
+		c.String(),
+		withSerial(soa, 12).String(),
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(xfrZone, dns.TypeIXFR)
+
+	for _, tt := range []struct {
+		deltas   []zoneDelta
+		expected []string
+	}{
+		{deltas, expected},
+		{nil, expected[:1]},
+	} {
+		rw := &recordingResponseWriter{}
+		err := (&xfrHandler{}).writeIXFR(&xfrWriter{rw: rw, req: req}, soa, 12, tt.deltas)
+		if err != nil {
+			t.Fatalf("couldn't write IXFR: %v", err)
+		}
+
+		var got []string
+		for _, m := range rw.msgs {
+			for _, rr := range m.Answer {
+				got = append(got, rr.String())
+			}
+		}
+
+		if len(got) != len(tt.expected) {
+			t.Errorf("expected %d records, got %d: %v", len(tt.expected), len(got), got)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("record %d: expected %s, got %s", i, tt.expected[i], got[i])
+			}
+		}
+	}
+}
+
+// Returns an empty zone store, as if it had been loaded at the given serial.
+func newLoadedZoneStore(t *testing.T, serial uint32) *zoneStore {
+	b, err := backend.New(&backend.Config{})
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+
+	zs := newZoneStore(namecoin.Conn{}, b, time.Second)
+	zs.loaded = true
+	zs.serial = serial
+	zs.records = map[string][]dns.RR{}
+	zs.values = map[string]string{}
+	zs.expires = map[string]int{}
+	zs.dependents = map[string]map[string]struct{}{}
+	zs.pending = map[string]*zoneUpdate{}
+	return zs
+}
+
+func TestZoneSerial(t *testing.T) {
+	zs := newLoadedZoneStore(t, 99)
+
+	// The serial is the height of the block committed, unless that would not
+	// increase it, as when blocks are replaced in a reorganisation.
+	for _, tt := range []struct {
+		height int
+		serial uint32
+	}{
+		{100, 100},
+		{100, 101},
+		{99, 102},
+		{200, 200},
+	} {
+		zs.commit(tt.height)
+		if zs.serial != tt.serial {
+			t.Errorf("after committing height %d: expected serial %d, got %d", tt.height, tt.serial, zs.serial)
+		}
+	}
+}
+
+func TestZoneExpiry(t *testing.T) {
+	zs := newLoadedZoneStore(t, 99)
+
+	value := `{"ip": "192.0.2.1"}`
+	zs.update("d/example", &value, 100)
+	zs.commit(100)
+
+	if len(zs.records["d/example"]) != 1 {
+		t.Fatalf("name was not added to the zone: %v", zs.records)
+	}
+
+	zs.commit(100 + nameExpiryDepth - 1)
+	if len(zs.records["d/example"]) != 1 {
+		t.Fatalf("name was removed before it expired")
+	}
+
+	zs.commit(100 + nameExpiryDepth)
+	if _, ok := zs.records["d/example"]; ok {
+		t.Fatalf("expired name was not removed")
+	}
+
+	_, deltas, ok := zs.changesSince(100 + nameExpiryDepth - 1)
+	if !ok || len(deltas) != 1 || len(deltas[0].deleted) != 1 || len(deltas[0].added) != 0 {
+		t.Errorf("removal of the expired name was not journaled: %v", deltas)
+	}
+}